@@ -1,52 +1,243 @@
 package client
 
 import (
+	"context"
 	"errors"
 	netx "github.com/awesome-cap/kv/net"
-	"log"
+	"github.com/awesome-cap/kv/ptl"
 	"net"
+	"time"
 )
 
+var (
+	ClientClosedError  = errors.New("Client closed. ")
+	BrokenConnectError = errors.New("Connection broken by a failed command. ")
+)
+
+// ServerError is an error replied by the server, the connection stays
+// usable.
+type ServerError struct {
+	Msg string
+}
+
+func (e *ServerError) Error() string {
+	return e.Msg
+}
+
+// Options of a Client. Zero timeouts disable them.
+type Options struct {
+	// Idle connections dialed ahead and kept open
+	MinIdle int
+	// Idle connections kept for reuse, the others are closed once released
+	MaxIdle int
+
+	DialTimeout time.Duration
+	// Commands blocking longer than ReadTimeout, like BLPOP, need a larger one
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// Idle connections are pinged when reused after this long, and by the
+	// health checker at this interval. Zero disables health checks.
+	HealthCheckInterval time.Duration
+
+	// Failed dials are retried MaxRetries times, waiting from MinBackoff,
+	// doubled on every retry, up to MaxBackoff
+	MaxRetries int
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+func DefaultOptions() Options {
+	return Options{
+		MinIdle:             0,
+		MaxIdle:             8,
+		DialTimeout:         5 * time.Second,
+		ReadTimeout:         3 * time.Second,
+		WriteTimeout:        3 * time.Second,
+		HealthCheckInterval: time.Minute,
+		MaxRetries:          3,
+		MinBackoff:          8 * time.Millisecond,
+		MaxBackoff:          512 * time.Millisecond,
+	}
+}
+
+// Client is a pool of connections to a server, safe for concurrent use.
 type Client struct {
 	addr string
+	opts Options
+	pool *pool
 }
 
+// Connect is a single connection, not safe for concurrent use.
 type Connect struct {
-	conn *netx.Conn
+	conn       *netx.Conn
+	nativeConn net.Conn
+	opts       Options
+	// A connection failed in the middle of a command is out of sync
+	broken bool
+	usedAt time.Time
 }
 
 func New(addr string) *Client {
-	return &Client{addr: addr}
+	return NewWithOptions(addr, DefaultOptions())
 }
 
+func NewWithOptions(addr string, opts Options) *Client {
+	c := &Client{addr: addr, opts: opts}
+	c.pool = newPool(c)
+	return c
+}
+
+// Connect dials a connection of its own, outside of the pool.
 func (c *Client) Connect() (*Connect, error) {
-	tcpAddr, err := net.ResolveTCPAddr("tcp", c.addr)
-	if err != nil {
-		log.Panicln(err)
+	return c.ConnectContext(context.Background())
+}
+
+func (c *Client) ConnectContext(ctx context.Context) (*Connect, error) {
+	if c.opts.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.opts.DialTimeout)
+		defer cancel()
 	}
-	nativeConn, err := net.DialTCP("tcp", nil, tcpAddr)
+	dialer := net.Dialer{}
+	nativeConn, err := dialer.DialContext(ctx, "tcp", c.addr)
 	if err != nil {
-		log.Panicln(err)
+		return nil, err
 	}
 	return &Connect{
-		conn: netx.NewConn(nativeConn),
+		conn:       netx.NewConn(nativeConn),
+		nativeConn: nativeConn,
+		opts:       c.opts,
+		usedAt:     time.Now(),
 	}, nil
 }
 
-func (c *Connect) Cmd(args ...string) ([]string, error) {
-	err := c.conn.Write(args)
+// dial connects, retrying with backoff until MaxRetries or ctx is done.
+func (c *Client) dial(ctx context.Context) (*Connect, error) {
+	for retries := 0; ; retries++ {
+		connect, err := c.ConnectContext(ctx)
+		if err == nil || retries >= c.opts.MaxRetries {
+			return connect, err
+		}
+		timer := time.NewTimer(backoff(retries, c.opts.MinBackoff, c.opts.MaxBackoff))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// backoff returns the wait before the given retry.
+func backoff(retries int, min, max time.Duration) time.Duration {
+	d := min
+	for i := 0; i < retries && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+// Cmd executes a command on a pooled connection. Commands are not retried,
+// after a failure they may or may not have been applied.
+func (c *Client) Cmd(ctx context.Context, args ...string) (ptl.Reply, error) {
+	connect, err := c.pool.get(ctx)
 	if err != nil {
-		return nil, err
+		return ptl.Reply{}, err
+	}
+	defer c.pool.put(connect)
+	return connect.CmdContext(ctx, args...)
+}
+
+// Close closes the idle connections, and the others once released.
+func (c *Client) Close() error {
+	return c.pool.close()
+}
+
+// Stats reports the connections of the pool.
+func (c *Client) Stats() PoolStats {
+	return c.pool.stats()
+}
+
+// Cmd sends a command and returns its reply, error replies as errors.
+func (c *Connect) Cmd(args ...string) (ptl.Reply, error) {
+	return c.CmdContext(context.Background(), args...)
+}
+
+// CmdContext is Cmd giving up once ctx is done, the connection can't be used
+// anymore then.
+func (c *Connect) CmdContext(ctx context.Context, args ...string) (ptl.Reply, error) {
+	if c.broken {
+		return ptl.Reply{}, BrokenConnectError
+	}
+	stop := c.watch(ctx)
+	reply, err := c.roundTrip(args)
+	if interrupted := stop(); interrupted != nil {
+		err = interrupted
 	}
-	resp, err := c.conn.Read()
 	if err != nil {
-		return nil, err
+		c.broken = true
+		return ptl.Reply{}, err
 	}
-	if len(resp) < 2 {
-		return nil, errors.New("Server response error. ")
+	if reply.Type == ptl.ErrorReply {
+		return ptl.Reply{}, &ServerError{Msg: reply.Str}
 	}
-	if resp[0] == "fail" {
-		return nil, errors.New(resp[1])
+	return reply, nil
+}
+
+func (c *Connect) roundTrip(args []string) (ptl.Reply, error) {
+	c.deadline(c.nativeConn.SetWriteDeadline, c.opts.WriteTimeout)
+	err := c.conn.Write(args)
+	if err != nil {
+		return ptl.Reply{}, err
 	}
-	return resp[1:], nil
+	c.deadline(c.nativeConn.SetReadDeadline, c.opts.ReadTimeout)
+	return c.conn.ReadReply()
+}
+
+func (c *Connect) deadline(set func(time.Time) error, timeout time.Duration) {
+	t := time.Time{}
+	if timeout > 0 {
+		t = time.Now().Add(timeout)
+	}
+	_ = set(t)
+}
+
+// watch interrupts the connection once ctx is done. The returned func stops
+// watching and returns the error of ctx if it interrupted.
+func (c *Connect) watch(ctx context.Context) func() error {
+	c.usedAt = time.Now()
+	if ctx.Done() == nil {
+		return func() error { return nil }
+	}
+	done := make(chan struct{})
+	interrupted := make(chan error, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// A deadline in the past unblocks the pending read or write
+			_ = c.nativeConn.SetDeadline(time.Unix(1, 0))
+			interrupted <- ctx.Err()
+		case <-done:
+			interrupted <- nil
+		}
+	}()
+	return func() error {
+		close(done)
+		return <-interrupted
+	}
+}
+
+// ping checks a connection is still usable.
+func (c *Connect) ping(ctx context.Context) error {
+	_, err := c.CmdContext(ctx, "ping")
+	return err
+}
+
+func (c *Connect) Close() error {
+	c.broken = true
+	return c.nativeConn.Close()
 }
@@ -0,0 +1,127 @@
+package client
+
+import (
+	"context"
+	"strconv"
+	"time"
+)
+
+// NoDeadline is the TTL of keys which don't expire.
+const NoDeadline time.Duration = -1
+
+// SetOptions of Set, the zero value sets the key unconditionally and
+// without deadline.
+type SetOptions struct {
+	// Expire the key after TTL, rounded up to milliseconds
+	TTL time.Duration
+	// Only set the key if it does not exist
+	NX bool
+}
+
+func milliseconds(d time.Duration) string {
+	ms := (d + time.Millisecond - 1) / time.Millisecond
+	return strconv.FormatInt(int64(ms), 10)
+}
+
+func (c *Client) Get(ctx context.Context, key string) (string, bool, error) {
+	return optional(String(c.Cmd(ctx, "get", key)))
+}
+
+// Set returns false if NX was given and the key exists.
+func (c *Client) Set(ctx context.Context, key, value string, opts SetOptions) (bool, error) {
+	args := []string{"set", key, value}
+	if opts.TTL > 0 {
+		args = append(args, "PX", milliseconds(opts.TTL))
+	}
+	if opts.NX {
+		args = append(args, "NX")
+	}
+	_, ok, err := optional(String(c.Cmd(ctx, args...)))
+	return ok, err
+}
+
+// Del returns the number of keys deleted.
+func (c *Client) Del(ctx context.Context, keys ...string) (int, error) {
+	n, err := Int64(c.Cmd(ctx, append([]string{"del"}, keys...)...))
+	return int(n), err
+}
+
+// Exists returns the number of keys which exist.
+func (c *Client) Exists(ctx context.Context, keys ...string) (int, error) {
+	n, err := Int64(c.Cmd(ctx, append([]string{"exists"}, keys...)...))
+	return int(n), err
+}
+
+func (c *Client) Incr(ctx context.Context, key string) (int64, error) {
+	return Int64(c.Cmd(ctx, "incr", key))
+}
+
+func (c *Client) IncrBy(ctx context.Context, key string, incr int64) (int64, error) {
+	return Int64(c.Cmd(ctx, "incrby", key, strconv.FormatInt(incr, 10)))
+}
+
+// Expire returns false if the key does not exist.
+func (c *Client) Expire(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	return Bool(c.Cmd(ctx, "pexpire", key, milliseconds(ttl)))
+}
+
+// TTL returns NoDeadline for keys which don't expire, false if the key does
+// not exist.
+func (c *Client) TTL(ctx context.Context, key string) (time.Duration, bool, error) {
+	ms, err := Int64(c.Cmd(ctx, "pttl", key))
+	switch {
+	case err != nil || ms == -2:
+		return 0, false, err
+	case ms == -1:
+		return NoDeadline, true, nil
+	}
+	return time.Duration(ms) * time.Millisecond, true, nil
+}
+
+// HSet returns true if the field is new.
+func (c *Client) HSet(ctx context.Context, key, field, value string) (bool, error) {
+	return Bool(c.Cmd(ctx, "hset", key, field, value))
+}
+
+func (c *Client) HGet(ctx context.Context, key, field string) (string, bool, error) {
+	return optional(String(c.Cmd(ctx, "hget", key, field)))
+}
+
+func (c *Client) HGetAll(ctx context.Context, key string) (map[string]string, error) {
+	return StringMap(c.Cmd(ctx, "hgetall", key))
+}
+
+// HDel returns the number of fields deleted.
+func (c *Client) HDel(ctx context.Context, key string, fields ...string) (int, error) {
+	n, err := Int64(c.Cmd(ctx, append([]string{"hdel", key}, fields...)...))
+	return int(n), err
+}
+
+// LPush returns the length of the list.
+func (c *Client) LPush(ctx context.Context, key string, values ...string) (int, error) {
+	n, err := Int64(c.Cmd(ctx, append([]string{"lpush", key}, values...)...))
+	return int(n), err
+}
+
+// RPush returns the length of the list.
+func (c *Client) RPush(ctx context.Context, key string, values ...string) (int, error) {
+	n, err := Int64(c.Cmd(ctx, append([]string{"rpush", key}, values...)...))
+	return int(n), err
+}
+
+func (c *Client) LPop(ctx context.Context, key string) (string, bool, error) {
+	return optional(String(c.Cmd(ctx, "lpop", key)))
+}
+
+func (c *Client) RPop(ctx context.Context, key string) (string, bool, error) {
+	return optional(String(c.Cmd(ctx, "rpop", key)))
+}
+
+func (c *Client) LRange(ctx context.Context, key string, start, stop int) ([]string, error) {
+	return Strings(c.Cmd(ctx, "lrange", key, strconv.Itoa(start), strconv.Itoa(stop)))
+}
+
+func (c *Client) LLen(ctx context.Context, key string) (int, error) {
+	n, err := Int64(c.Cmd(ctx, "llen", key))
+	return int(n), err
+}
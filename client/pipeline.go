@@ -0,0 +1,109 @@
+package client
+
+import (
+	"context"
+	"github.com/awesome-cap/kv/ptl"
+	"sync"
+)
+
+// Pipeline queues commands to send them in one write and read their replies
+// in order, saving a round trip per command.
+type Pipeline struct {
+	client  *Client
+	connect *Connect
+	cmds    [][]string
+}
+
+// Pipeline returns a pipeline executed on a pooled connection.
+func (c *Client) Pipeline() *Pipeline {
+	return &Pipeline{client: c}
+}
+
+func (c *Connect) Pipeline() *Pipeline {
+	return &Pipeline{connect: c}
+}
+
+// Cmd queues a command until Exec.
+func (p *Pipeline) Cmd(args ...string) {
+	p.cmds = append(p.cmds, args)
+}
+
+func (p *Pipeline) Len() int {
+	return len(p.cmds)
+}
+
+func (p *Pipeline) Exec() ([]ptl.Reply, error) {
+	return p.ExecContext(context.Background())
+}
+
+// ExecContext sends the queued commands and returns their replies in order,
+// error replies included. The queue is emptied either way.
+func (p *Pipeline) ExecContext(ctx context.Context) ([]ptl.Reply, error) {
+	cmds := p.cmds
+	p.cmds = nil
+	if len(cmds) == 0 {
+		return nil, nil
+	}
+	if p.connect != nil {
+		return p.connect.exec(ctx, cmds)
+	}
+	connect, err := p.client.pool.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer p.client.pool.put(connect)
+	return connect.exec(ctx, cmds)
+}
+
+// exec pipelines cmds. The replies are read while the commands are written,
+// so that neither end blocks on a full buffer. After an error the connection
+// is closed.
+func (c *Connect) exec(ctx context.Context, cmds [][]string) ([]ptl.Reply, error) {
+	if c.broken {
+		return nil, BrokenConnectError
+	}
+	// The first error is the cause, closing the connection unblocks the
+	// other side
+	var once sync.Once
+	var cause error
+	fail := func(err error) {
+		once.Do(func() {
+			cause = err
+			_ = c.Close()
+		})
+	}
+	stop := c.watch(ctx)
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		c.deadline(c.nativeConn.SetWriteDeadline, c.opts.WriteTimeout)
+		for _, args := range cmds {
+			if err := c.conn.Send(args); err != nil {
+				fail(err)
+				return
+			}
+		}
+		if err := c.conn.Flush(); err != nil {
+			fail(err)
+		}
+	}()
+	replies := make([]ptl.Reply, 0, len(cmds))
+	for range cmds {
+		c.deadline(c.nativeConn.SetReadDeadline, c.opts.ReadTimeout)
+		reply, err := c.conn.ReadReply()
+		if err != nil {
+			fail(err)
+			break
+		}
+		replies = append(replies, reply)
+	}
+	<-written
+	if interrupted := stop(); interrupted != nil {
+		fail(interrupted)
+		return nil, interrupted
+	}
+	if cause != nil {
+		return nil, cause
+	}
+	return replies, nil
+}
@@ -0,0 +1,205 @@
+package client
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// PoolStats counts the connections of a pool.
+type PoolStats struct {
+	Idle   int
+	Active int
+	// Connections dialed, and closed after failing or beyond MaxIdle
+	Dials  uint64
+	Closes uint64
+	// Idle connections which failed their health check
+	Stale uint64
+}
+
+// pool keeps idle connections for reuse, the most recently used first.
+type pool struct {
+	client *Client
+	stop   chan struct{}
+
+	mu     sync.Mutex
+	idle   []*Connect
+	active int
+	closed bool
+	counts PoolStats
+}
+
+func newPool(client *Client) *pool {
+	p := &pool{client: client, stop: make(chan struct{})}
+	if client.opts.HealthCheckInterval > 0 {
+		go p.check()
+	}
+	go p.fill()
+	return p
+}
+
+// get returns an idle connection, checked if it was idle for long, or dials
+// a new one.
+func (p *pool) get(ctx context.Context) (*Connect, error) {
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, ClientClosedError
+		}
+		n := len(p.idle)
+		if n == 0 {
+			p.active++
+			p.counts.Dials++
+			p.mu.Unlock()
+			break
+		}
+		c := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.active++
+		p.mu.Unlock()
+		if !p.stale(ctx, c) {
+			return c, nil
+		}
+		p.discard(c, true)
+	}
+	c, err := p.client.dial(ctx)
+	if err != nil {
+		p.mu.Lock()
+		p.active--
+		p.mu.Unlock()
+		return nil, err
+	}
+	return c, nil
+}
+
+// stale pings c if it was idle longer than the health check interval.
+func (p *pool) stale(ctx context.Context, c *Connect) bool {
+	interval := p.client.opts.HealthCheckInterval
+	if interval <= 0 || time.Since(c.usedAt) < interval {
+		return false
+	}
+	return c.ping(ctx) != nil
+}
+
+// put releases c, it is closed if broken or beyond MaxIdle.
+func (p *pool) put(c *Connect) {
+	p.mu.Lock()
+	if c.broken || p.closed || len(p.idle) >= p.client.opts.MaxIdle {
+		p.mu.Unlock()
+		p.discard(c, false)
+		return
+	}
+	p.active--
+	p.idle = append(p.idle, c)
+	p.mu.Unlock()
+}
+
+// discard closes an active connection.
+func (p *pool) discard(c *Connect, stale bool) {
+	_ = c.Close()
+	p.mu.Lock()
+	p.active--
+	p.counts.Closes++
+	if stale {
+		p.counts.Stale++
+	}
+	p.mu.Unlock()
+	p.wake()
+}
+
+// wake refills the idle connections up to MinIdle in the background.
+func (p *pool) wake() {
+	if p.client.opts.MinIdle > 0 {
+		go p.fill()
+	}
+}
+
+func (p *pool) fill() {
+	for {
+		p.mu.Lock()
+		opts := p.client.opts
+		if p.closed || len(p.idle) >= opts.MinIdle || len(p.idle) >= opts.MaxIdle {
+			p.mu.Unlock()
+			return
+		}
+		p.active++
+		p.counts.Dials++
+		p.mu.Unlock()
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			select {
+			case <-p.stop:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		c, err := p.client.dial(ctx)
+		cancel()
+		if err != nil {
+			p.mu.Lock()
+			p.active--
+			p.mu.Unlock()
+			return
+		}
+		p.put(c)
+	}
+}
+
+// check pings the idle connections at the health check interval, the failed
+// ones are replaced.
+func (p *pool) check() {
+	interval := p.client.opts.HealthCheckInterval
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+		p.mu.Lock()
+		idle := p.idle
+		p.idle = nil
+		p.active += len(idle)
+		p.mu.Unlock()
+		for _, c := range idle {
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			if p.stale(ctx, c) {
+				p.discard(c, true)
+			} else {
+				p.put(c)
+			}
+			cancel()
+		}
+		p.fill()
+	}
+}
+
+func (p *pool) close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return ClientClosedError
+	}
+	p.closed = true
+	idle := p.idle
+	p.idle = nil
+	p.mu.Unlock()
+	close(p.stop)
+	var err error
+	for _, c := range idle {
+		if closeErr := c.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+func (p *pool) stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := p.counts
+	stats.Idle, stats.Active = len(p.idle), p.active
+	return stats
+}
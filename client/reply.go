@@ -0,0 +1,100 @@
+package client
+
+import (
+	"errors"
+	"github.com/awesome-cap/kv/ptl"
+	"strconv"
+)
+
+var (
+	NilError = errors.New("Nil reply. ")
+)
+
+// The helpers below convert the reply of a command, passing its error
+// through, like String(c.Cmd(ctx, "get", key)). A nil reply converts to
+// NilError.
+
+func String(reply ptl.Reply, err error) (string, error) {
+	if err != nil {
+		return "", err
+	}
+	if reply.Type == ptl.NilReply || reply.Type == ptl.NilArrayReply {
+		return "", NilError
+	}
+	return reply.String(), nil
+}
+
+func Int64(reply ptl.Reply, err error) (int64, error) {
+	if err != nil {
+		return 0, err
+	}
+	switch reply.Type {
+	case ptl.NilReply, ptl.NilArrayReply:
+		return 0, NilError
+	case ptl.IntegerReply:
+		return reply.Integer, nil
+	}
+	return strconv.ParseInt(reply.Str, 10, 64)
+}
+
+func Float64(reply ptl.Reply, err error) (float64, error) {
+	if err != nil {
+		return 0, err
+	}
+	switch reply.Type {
+	case ptl.NilReply, ptl.NilArrayReply:
+		return 0, NilError
+	case ptl.IntegerReply:
+		return float64(reply.Integer), nil
+	}
+	return strconv.ParseFloat(reply.Str, 64)
+}
+
+// Bool converts integer replies, 1 is true.
+func Bool(reply ptl.Reply, err error) (bool, error) {
+	i, err := Int64(reply, err)
+	return i == 1, err
+}
+
+// Strings converts arrays, sets and maps, nil items convert to "".
+func Strings(reply ptl.Reply, err error) ([]string, error) {
+	if err != nil {
+		return nil, err
+	}
+	switch reply.Type {
+	case ptl.NilReply, ptl.NilArrayReply:
+		return nil, NilError
+	case ptl.ArrayReply, ptl.SetReply, ptl.MapReply:
+		items := make([]string, 0, len(reply.Array))
+		for _, item := range reply.Array {
+			if item.Type == ptl.NilReply {
+				items = append(items, "")
+				continue
+			}
+			items = append(items, item.Strings()...)
+		}
+		return items, nil
+	}
+	return []string{reply.String()}, nil
+}
+
+// StringMap converts maps and arrays of keys and values.
+func StringMap(reply ptl.Reply, err error) (map[string]string, error) {
+	items, err := Strings(reply, err)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]string, len(items)/2)
+	for i := 0; i+1 < len(items); i += 2 {
+		m[items[i]] = items[i+1]
+	}
+	return m, nil
+}
+
+// optional turns NilError into a missing value.
+func optional(s string, err error) (string, bool, error) {
+	if err == NilError {
+		return "", false, nil
+	}
+	return s, err == nil, err
+}
@@ -3,9 +3,12 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"fmt"
 	"github.com/awesome-cap/kv/client"
+	"github.com/awesome-cap/kv/ptl"
 	"log"
 	"os"
+	"strconv"
 	"strings"
 )
 
@@ -51,7 +54,40 @@ func main() {
 		if buffer.Len() > 0 {
 			args = append(args, buffer.String())
 		}
-		resp, err := connect.Cmd(args...)
-		log.Println("error: ", err, "response: ", resp)
+		reply, err := connect.Cmd(args...)
+		if err != nil {
+			log.Println("error: ", err)
+			continue
+		}
+		fmt.Print(format(reply, ""))
+	}
+}
+
+// format prints a reply the way redis-cli does, nested items indented.
+func format(reply ptl.Reply, indent string) string {
+	switch reply.Type {
+	case ptl.NilReply, ptl.NilArrayReply:
+		return "(nil)\n"
+	case ptl.IntegerReply:
+		return fmt.Sprintf("(integer) %d\n", reply.Integer)
+	case ptl.BulkReply:
+		return strconv.Quote(reply.Str) + "\n"
+	case ptl.DoubleReply:
+		return fmt.Sprintf("(double) %s\n", reply.Str)
+	case ptl.ArrayReply, ptl.MapReply, ptl.SetReply:
+		if len(reply.Array) == 0 {
+			return "(empty array)\n"
+		}
+		buffer := bytes.Buffer{}
+		for i, item := range reply.Array {
+			prefix := fmt.Sprintf("%d) ", i+1)
+			if i > 0 {
+				buffer.WriteString(indent)
+			}
+			buffer.WriteString(prefix)
+			buffer.WriteString(format(item, indent+strings.Repeat(" ", len(prefix))))
+		}
+		return buffer.String()
 	}
+	return reply.Str + "\n"
 }
@@ -1,13 +1,19 @@
 package main
 
 import (
+	"context"
 	"github.com/awesome-cap/kv/config"
 	"github.com/awesome-cap/kv/engine"
 	"github.com/awesome-cap/kv/net"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
+const shutdownTimeout = 10 * time.Second
+
 func main() {
 	conf := config.Default()
 	if len(os.Args) > 1 {
@@ -24,9 +30,45 @@ func main() {
 	}
 
 	tcpServer := net.NewTcp(":8888")
-	err = tcpServer.Serve(func(args []string) ([]string, error) {
-		return e.Exec(args)
-	})
+	servers := []interface {
+		Shutdown(ctx context.Context) error
+	}{tcpServer}
+	// Redis clients connect to the RESP listener
+	if conf.Resp.Enable {
+		respServer := net.NewResp(conf.Resp.Addr)
+		servers = append(servers, respServer)
+		go func() {
+			// The tcp listener goes on serving without it
+			err := respServer.Serve(e.ExecContext)
+			if err != net.ServerClosedError {
+				log.Println("Resp server:", err)
+			}
+		}()
+	}
+
+	// Shutdown on SIGINT/SIGTERM, the commands in flight are answered first
+	shutdown := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-signals
+		log.Println("Received", sig, ", shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		for _, server := range servers {
+			if err := server.Shutdown(ctx); err != nil {
+				log.Println(err)
+			}
+		}
+		close(shutdown)
+	}()
+
+	err = tcpServer.Serve(e.ExecContext)
+	if err != net.ServerClosedError {
+		log.Panicln(err)
+	}
+	<-shutdown
+	err = e.Close()
 	if err != nil {
 		log.Panicln(err)
 	}
@@ -6,28 +6,59 @@ import (
 )
 
 type Config struct {
+	Resp    Resp    `yaml:"resp"`
 	Storage Storage `yaml:"storage"`
 }
 
+// Resp is the listener for Redis clients.
+type Resp struct {
+	Enable bool   `yaml:"enable"`
+	Addr   string `yaml:"addr"`
+}
+
 type Storage struct {
-	Dir string `yaml:"dir"`
-	Log Log    `yaml:"log"`
-	DB  DB     `yaml:"db"`
+	Dir   string `yaml:"dir"`
+	Log   Log    `yaml:"log"`
+	DB    DB     `yaml:"db"`
+	Cache Cache  `yaml:"cache"`
 }
 
+// Fsync policies of the redo log
+const (
+	FsyncAlways   = "always"
+	FsyncEverySec = "everysec"
+	FsyncNo       = "no"
+)
+
 type Log struct {
 	Enable bool `yaml:"enable"`
+	// One of the fsync policies, empty falls back to DB.FlushMethod
+	Fsync string `yaml:"fsync"`
 }
 
 type DB struct {
 	Enable        bool  `yaml:"enable"`
 	FilingSize    int64 `yaml:"filingSize"`
-	FlushMethod   int   `yaml:"flushMethod"`
+	FlushMethod   int   `yaml:"flushMethod"` // 0 no, 1 everysec, 2 always
 	FlushInterval uint  `yaml:"flushInterval"`
+
+	// Compaction triggers of archived dbs, zero disables a trigger
+	CompactFiles int     `yaml:"compactFiles"`
+	CompactSize  int64   `yaml:"compactSize"`
+	CompactRatio float64 `yaml:"compactRatio"`
+}
+
+type Cache struct {
+	// Bytes of archived dbs kept loaded, measured by their file size
+	Size int64 `yaml:"size"`
 }
 
 func Default() Config {
 	return Config{
+		Resp: Resp{
+			Enable: true,
+			Addr:   ":6379",
+		},
 		Storage: Storage{
 			Log: Log{
 				Enable: true,
@@ -37,6 +68,12 @@ func Default() Config {
 				FilingSize:    1048576 * 100,
 				FlushMethod:   1,
 				FlushInterval: 5,
+				CompactFiles:  8,
+				CompactSize:   1048576 * 1024,
+				CompactRatio:  4,
+			},
+			Cache: Cache{
+				Size: 1048576 * 256,
 			},
 		},
 	}
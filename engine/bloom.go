@@ -0,0 +1,66 @@
+package engine
+
+import (
+	"hash/fnv"
+)
+
+const (
+	bloomBitsPerKey = 10
+	bloomHashes     = 7
+)
+
+// bloom is a bloom filter over the keys of a table, it lets lookups of keys
+// the table doesn't hold skip reading a block.
+type bloom struct {
+	k    uint8
+	bits []byte
+}
+
+func newBloom(keys int) *bloom {
+	n := (keys*bloomBitsPerKey + 7) / 8
+	if n == 0 {
+		n = 1
+	}
+	return &bloom{k: bloomHashes, bits: make([]byte, n)}
+}
+
+// positions derives the k bit positions of key from two halves of a 64-bit
+// hash.
+func (b *bloom) positions(key string, fn func(bit uint32)) {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	sum := h.Sum64()
+	h1, h2 := uint32(sum), uint32(sum>>32)
+	m := uint32(len(b.bits) * 8)
+	for i := uint32(0); i < uint32(b.k); i++ {
+		fn((h1 + i*h2) % m)
+	}
+}
+
+func (b *bloom) add(key string) {
+	b.positions(key, func(bit uint32) {
+		b.bits[bit/8] |= 1 << (bit % 8)
+	})
+}
+
+// has reports false only for keys which were never added.
+func (b *bloom) has(key string) bool {
+	found := true
+	b.positions(key, func(bit uint32) {
+		if b.bits[bit/8]&(1<<(bit%8)) == 0 {
+			found = false
+		}
+	})
+	return found
+}
+
+func (b *bloom) marshal() []byte {
+	return append([]byte{b.k}, b.bits...)
+}
+
+func unMarshalBloom(data []byte) (*bloom, error) {
+	if len(data) < 2 {
+		return nil, CorruptedDBError
+	}
+	return &bloom{k: data[0], bits: data[1:]}, nil
+}
@@ -0,0 +1,158 @@
+package engine
+
+import (
+	"container/list"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// CacheStats are the counters of the archive cache.
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	// Loaded archives and their size
+	Entries int
+	Size    int64
+}
+
+// cache keeps the engines of archived dbs loaded. Once their size, taken as
+// the size of their files, exceeds limit the least recently used ones are
+// evicted.
+type cache struct {
+	sync.Mutex
+
+	limit int64
+	lru   *list.List
+	items map[*db]*list.Element
+	stats CacheStats
+}
+
+type cached struct {
+	d    *db
+	e    *Engine
+	size int64
+}
+
+func newCache(limit int64) *cache {
+	return &cache{limit: limit, lru: list.New(), items: map[*db]*list.Element{}}
+}
+
+func (c *cache) get(d *db) (*Engine, bool) {
+	c.Lock()
+	defer c.Unlock()
+	item, ok := c.items[d]
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+	c.stats.Hits++
+	c.lru.MoveToFront(item)
+	return item.Value.(*cached).e, true
+}
+
+// peek is get without touching the counters or the order.
+func (c *cache) peek(d *db) (*Engine, bool) {
+	c.Lock()
+	defer c.Unlock()
+	if item, ok := c.items[d]; ok {
+		return item.Value.(*cached).e, true
+	}
+	return nil, false
+}
+
+// add caches e as the engine of d, an engine larger than the whole cache is
+// not kept.
+func (c *cache) add(d *db, e *Engine, size int64) {
+	c.Lock()
+	defer c.Unlock()
+	c.remove(d)
+	if size > c.limit {
+		return
+	}
+	c.items[d] = c.lru.PushFront(&cached{d: d, e: e, size: size})
+	c.stats.Size += size
+	for c.stats.Size > c.limit {
+		c.remove(c.lru.Back().Value.(*cached).d)
+		c.stats.Evictions++
+	}
+}
+
+// remove drops the engine of d, c must be locked.
+func (c *cache) remove(d *db) {
+	item, ok := c.items[d]
+	if !ok {
+		return
+	}
+	c.lru.Remove(item)
+	delete(c.items, d)
+	c.stats.Size -= item.Value.(*cached).size
+}
+
+func (c *cache) evict(d *db) {
+	c.Lock()
+	defer c.Unlock()
+	c.remove(d)
+}
+
+func (c *cache) counters() CacheStats {
+	c.Lock()
+	defer c.Unlock()
+	stats := c.stats
+	stats.Entries = c.lru.Len()
+	return stats
+}
+
+// engine returns the engine of an archived db, loading its file on a cache
+// miss.
+func (s *Storage) engine(d *db) (*Engine, error) {
+	if e, ok := s.cache.get(d); ok {
+		return e, nil
+	}
+	t, err := s.table(d)
+	if err != nil {
+		return nil, err
+	}
+	if t != nil {
+		e, err := t.load()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", d.path(), err)
+		}
+		s.cache.add(d, e, t.size)
+		return e, nil
+	}
+	err = d.open(os.O_RDONLY)
+	defer d.close()
+	if err != nil {
+		return nil, err
+	}
+	// Loaded by another reader while this one waited for the db
+	if e, ok := s.cache.peek(d); ok {
+		return e, nil
+	}
+	info, err := d.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	e := newEngine()
+	err = e.UnMarshal(d.file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", d.path(), err)
+	}
+	s.cache.add(d, e, info.Size())
+	return e, nil
+}
+
+// CacheStats returns the counters of the archive cache.
+func (s *Storage) CacheStats() CacheStats {
+	return s.cache.counters()
+}
+
+// CacheStats returns the counters of the storage's archive cache.
+func (e *Engine) CacheStats() CacheStats {
+	if e.storage == nil {
+		return CacheStats{}
+	}
+	return e.storage.CacheStats()
+}
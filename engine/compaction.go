@@ -0,0 +1,165 @@
+package engine
+
+import (
+	"github.com/awesome-cap/hashmap"
+	"io"
+	"os"
+)
+
+// archived returns the stabled dbs from newest to oldest.
+func (s *Storage) archived() dbs {
+	s.RLock()
+	defer s.RUnlock()
+	archived := dbs{}
+	for i := s.dbs.Len() - 1; i >= 0; i-- {
+		if s.dbs[i].state == S {
+			archived = append(archived, s.dbs[i])
+		}
+	}
+	return archived
+}
+
+// compactable reports whether the archived dbs hit one of the compaction
+// triggers: the number of files, their total size, or the ratio of the total
+// size to the newest archive, which holds roughly the live data.
+func (s *Storage) compactable() bool {
+	conf := s.conf.DB
+	if !conf.Enable {
+		return false
+	}
+	archived := s.archived()
+	if archived.Len() < 2 {
+		return false
+	}
+	if conf.CompactFiles > 0 && archived.Len() >= conf.CompactFiles {
+		return true
+	}
+	total, newest := int64(0), int64(0)
+	for i, d := range archived {
+		size, err := d.size()
+		if err != nil {
+			return false
+		}
+		if i == 0 {
+			newest = size
+		}
+		total += size
+	}
+	if conf.CompactSize > 0 && total >= conf.CompactSize {
+		return true
+	}
+	return conf.CompactRatio > 0 && newest > 0 && float64(total)/float64(newest) >= conf.CompactRatio
+}
+
+// compact merges all archived dbs into the newest one. Shadowed values and
+// tombstones are dropped, the merged db replaces the newest archive with an
+// atomic rename and the older archive files are removed afterwards. A crash
+// before the removal leaves files which the compacted flag hides.
+func (s *Storage) compact(e *Engine) error {
+	archived := s.archived()
+	if archived.Len() < 2 {
+		return nil
+	}
+	merged := newEngine()
+	merged.compacted = true
+	shadowed := map[string]bool{}
+	for i, d := range archived {
+		a, err := s.engine(d)
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			merged.lsn = a.lsn
+		}
+		a.merge(merged, shadowed)
+		if a.compacted {
+			break
+		}
+	}
+
+	newest := archived[0]
+	err := s.writeFile(newest.path(), func(w io.Writer) error {
+		return writeTable(w, merged)
+	})
+	if err != nil {
+		return err
+	}
+	size, err := newest.size()
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	for _, d := range archived {
+		d.forget()
+		s.cache.evict(d)
+	}
+	s.cache.add(newest, merged, size)
+	kept := dbs{}
+	for _, d := range s.dbs {
+		if d.state != S || d == newest {
+			kept = append(kept, d)
+		}
+	}
+	s.dbs = kept
+	s.Unlock()
+
+	for _, d := range archived[1:] {
+		if err := os.Remove(d.path()); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	e.prune(func(key string) bool {
+		_, ok := merged.string.Get(key)
+		return ok
+	})
+	return nil
+}
+
+// merge copies the live entries of an archived engine into merged, skipping
+// keys a newer archive has decided already.
+func (e *Engine) merge(merged *Engine, shadowed map[string]bool) {
+	for name, space := range e.spaces() {
+		target := merged.spaces()[name]
+		space.Foreach(func(entry *hashmap.Entry) {
+			key := entry.Key().(string)
+			if shadowed[key] {
+				return
+			}
+			shadowed[key] = true
+			if e.expired(key) {
+				return
+			}
+			target.Set(key, entry.Value())
+			if at, ok := e.expire.Get(key); ok {
+				merged.expire.Set(key, at)
+			}
+		})
+	}
+	e.tombstone.Foreach(func(entry *hashmap.Entry) {
+		shadowed[entry.Key().(string)] = true
+	})
+}
+
+// prune drops the tombstones of keys which no archived db holds, as nothing
+// is left for them to shadow. The archives are read without the engine lock,
+// only the storage daemon changes them.
+func (e *Engine) prune(holds func(key string) bool) {
+	e.RLock()
+	keys := make([]string, 0)
+	e.tombstone.Foreach(func(entry *hashmap.Entry) {
+		keys = append(keys, entry.Key().(string))
+	})
+	e.RUnlock()
+	dropped := make([]string, 0)
+	for _, key := range keys {
+		if !holds(key) {
+			dropped = append(dropped, key)
+		}
+	}
+	e.Lock()
+	defer e.Unlock()
+	for _, key := range dropped {
+		e.tombstone.Del(key)
+	}
+}
@@ -1,23 +1,72 @@
 package engine
 
 import (
+	"bufio"
 	"bytes"
+	"container/list"
+	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"github.com/awesome-cap/kv/config"
 	"github.com/awesome-cap/kv/ptl"
 	"github.com/awesome-cap/hashmap"
 	"io"
+	"io/ioutil"
+	"math"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	typeNone   = "none"
+	typeString = "string"
+	typeHash   = "hash"
+	typeList   = "list"
+	typeZSet   = "zset"
+	typeSet    = "set"
+)
+
+var (
+	ClosedError = errors.New("Engine closed. ")
+)
+
 type Engine struct {
+	sync.RWMutex
+
 	lsn      uint64
 	storage  *Storage
 	handlers map[string]handler
+	loading  bool
+	watchers map[string][]chan struct{}
 
 	string *hashmap.HashMap
+	hash   *hashmap.HashMap
+	list   *hashmap.HashMap
+	zset   *hashmap.HashMap
+	set    *hashmap.HashMap
+	expire *hashmap.HashMap
+
+	// Deleted keys, which shadow the values archived dbs still hold
+	tombstone *hashmap.HashMap
+	// Keys created since the last snapshot was captured, which no db file
+	// holds yet
+	fresh map[string]bool
+	// Every key, including the ones only archived dbs hold, by keyHash
+	index *skiplist
+	// Set on the result of a compaction, which replaces all older archives
+	compacted bool
+
+	// Running snapshots, and the keys whose values were copied since the
+	// last one started
+	snapshots int
+	copied    map[string]bool
+
+	// Set once by Close, stop ends the daemons
+	closed int32
+	stop   chan struct{}
 }
 
 func New(conf config.Config) (*Engine, error) {
@@ -25,53 +74,313 @@ func New(conf config.Config) (*Engine, error) {
 	if err != nil {
 		return nil, err
 	}
-	e := &Engine{
-		storage:  s,
-		handlers: map[string]handler{},
-		string:   hashmap.New(),
-	}
+	e := newEngine()
+	e.storage = s
 	e.Registry(Get, Set, Del)
+	e.Registry(Exists, Type, Rename, RenameNX, Keys, DBSize, RandomKey, Scan)
+	e.Registry(Info, Ping)
+	e.Registry(Incr, Decr, IncrBy, DecrBy, IncrByFloat, Append, GetSet, GetDel, SetRange, GetRange, StrLen)
+	e.Registry(MGet, MSet, MSetNX)
+	e.Registry(Expire, PExpire, ExpireAt, PExpireAt, TTL, PTTL, Persist)
+	e.Registry(HSet, HGet, HDel, HGetAll, HLen, HExists, HIncrBy)
+	e.Registry(LPush, RPush, LPop, RPop, LRange, LLen, LIndex, LTrim, BLPop, BRPop)
+	e.Registry(ZAdd, ZRem, ZScore, ZIncrBy, ZCard, ZRange, ZRevRange, ZRangeByScore, ZRank)
+	e.Registry(SAdd, SRem, SIsMember, SMembers, SCard, SPop, SRandMember)
+	e.Registry(SInter, SUnion, SDiff, SInterStore, SUnionStore, SDiffStore)
+	e.loading = true
 	err = s.loadDB(e)
 	if err != nil {
 		return nil, err
 	}
+	e.reindex()
 	err = s.loadLog(e)
 	if err != nil {
 		return nil, err
 	}
+	e.loading = false
 	s.startDaemon(e)
+	e.startDaemon()
 	return e, nil
 }
 
+func newEngine() *Engine {
+	return &Engine{
+		handlers: map[string]handler{},
+		string:   hashmap.New(),
+		watchers: map[string][]chan struct{}{},
+		hash:     hashmap.New(),
+		list:     hashmap.New(),
+		zset:     hashmap.New(),
+		set:      hashmap.New(),
+		expire:   hashmap.New(),
+
+		tombstone: hashmap.New(),
+		fresh:     map[string]bool{},
+		index:     newSkiplist(),
+		stop:      make(chan struct{}),
+	}
+}
+
+// spaces returns the key space of every data type by type name.
+func (e *Engine) spaces() map[string]*hashmap.HashMap {
+	return map[string]*hashmap.HashMap{
+		typeString: e.string,
+		typeHash:   e.hash,
+		typeList:   e.list,
+		typeZSet:   e.zset,
+		typeSet:    e.set,
+	}
+}
+
+func (e *Engine) typeOf(key string) string {
+	if e.expired(key) {
+		return typeNone
+	}
+	for t, space := range e.spaces() {
+		if _, ok := space.Get(key); ok {
+			return t
+		}
+	}
+	return typeNone
+}
+
+// store puts a new value into a key space, replacing the tombstone of key
+// if it was deleted before.
+func (e *Engine) store(space *hashmap.HashMap, key string, value interface{}) {
+	if e.archiving() && !e.tombstoned(key) && !e.inMemory(key) {
+		e.fresh[key] = true
+	}
+	space.Set(key, value)
+	e.tombstone.Del(key)
+	e.indexKey(key)
+}
+
+// archiving reports whether deleted keys may have values in db files, which
+// tombstones have to hide.
+func (e *Engine) archiving() bool {
+	return e.storage != nil && e.storage.conf.DB.Enable
+}
+
+func (e *Engine) tombstoned(key string) bool {
+	_, ok := e.tombstone.Get(key)
+	return ok
+}
+
+// find looks key up in an archived engine. The bool reports whether this
+// engine knows the key at all: a nil value then means the key was deleted,
+// expired or held another type, which hides older archived dbs as well.
+func (e *Engine) find(key string) (interface{}, bool) {
+	if e.expired(key) {
+		return nil, true
+	}
+	if v, ok := e.string.Get(key); ok {
+		return v, true
+	}
+	return nil, e.inMemory(key) || e.tombstoned(key)
+}
+
+// assertType fails with WrongTypeError if key holds a value of another type.
+func (e *Engine) assertType(key, t string) error {
+	if actual := e.typeOf(key); actual != typeNone && actual != t {
+		return WrongTypeError
+	}
+	return nil
+}
+
 func (e *Engine) Registry(handlers ...handler) {
 	for _, h := range handlers {
 		e.handlers[strings.ToLower(h.name())] = h
 	}
 }
 
-func (e *Engine) Exec(args []string) ([]string, error) {
+func (e *Engine) Exec(args []string) (ptl.Reply, error) {
+	return e.ExecContext(context.Background(), args)
+}
+
+// ExecContext executes a command, blocking commands give up waiting once
+// ctx is done.
+func (e *Engine) ExecContext(ctx context.Context, args []string) (ptl.Reply, error) {
 	err := assertArgsSize(args, 1)
 	if err != nil {
-		return nil, err
+		return ptl.Reply{}, err
+	}
+	if atomic.LoadInt32(&e.closed) == 1 {
+		return ptl.Reply{}, ClosedError
 	}
 	args[0] = strings.ToLower(args[0])
 	handler, ok := e.handlers[args[0]]
 	if !ok {
-		return nil, errors.New(fmt.Sprintf("Invalid cmd %s", args[0]))
+		return ptl.Reply{}, errors.New(fmt.Sprintf("Invalid cmd %s", args[0]))
 	}
 	err = assertArgsSize(args, handler.size())
 	if err != nil {
-		return nil, err
+		return ptl.Reply{}, err
 	}
-	if writeable[args[0]] {
-		e.lsn, err = e.storage.logging(args)
+	if !writeable[args[0]] {
+		e.RLock()
+		defer e.RUnlock()
+		return handler.handle(e, args)
+	}
+	if b, ok := handler.(blocker); ok {
+		return e.block(ctx, b, args)
+	}
+	reply, lsn, err := e.write(handler, args, nil)
+	if err != nil {
+		return ptl.Reply{}, err
+	}
+	return reply, e.storage.commit(lsn)
+}
+
+// write applies a write command under the lock, which is released even if
+// the handler panics. blocked is called under the lock as well, if the
+// command has to wait.
+func (e *Engine) write(handler handler, args []string, blocked func()) (ptl.Reply, uint64, error) {
+	e.Lock()
+	defer e.Unlock()
+	if e.closed == 1 {
+		return ptl.Reply{}, 0, ClosedError
+	}
+	reply, err := e.apply(handler, args)
+	if err == blockedError && blocked != nil {
+		blocked()
+	}
+	return reply, e.lsn, err
+}
+
+// apply rewrites, logs and executes a write command, e must be locked.
+func (e *Engine) apply(handler handler, args []string) (ptl.Reply, error) {
+	if e.storage.health.degraded() {
+		return ptl.Reply{}, ReadOnlyError
+	}
+	// Any arg may be a key the command reads, expired ones are deleted for
+	// good before it runs
+	err := e.purge(args[1:])
+	if err != nil {
+		return ptl.Reply{}, err
+	}
+	if r, ok := handler.(rewriter); ok {
+		args, err = r.rewrite(e, args)
 		if err != nil {
-			return nil, err
+			return ptl.Reply{}, err
 		}
+		handler = e.handlers[args[0]]
+	}
+	// Commands only change values in place at their first key
+	if len(args) > 1 {
+		e.touch(args[1])
+	}
+	e.lsn, err = e.storage.logging(args)
+	if err != nil {
+		return ptl.Reply{}, err
 	}
 	return handler.handle(e, args)
 }
 
+// block retries a blocking command every time one of its keys is signaled,
+// until it succeeds, times out or ctx is done. On timeout it replies a nil array.
+func (e *Engine) block(ctx context.Context, b blocker, args []string) (ptl.Reply, error) {
+	timeout, err := b.timeout(args)
+	if err != nil {
+		return ptl.Reply{}, err
+	}
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	keys := b.keys(args)
+	for {
+		var ch chan struct{}
+		reply, lsn, err := e.write(b, args, func() {
+			ch = e.watch(keys)
+		})
+		if err != blockedError {
+			if err != nil {
+				return ptl.Reply{}, err
+			}
+			return reply, e.storage.commit(lsn)
+		}
+		select {
+		case <-ch:
+			e.unwatch(keys, ch)
+		case <-deadline:
+			e.unwatch(keys, ch)
+			return ptl.NilArray(), nil
+		case <-ctx.Done():
+			e.unwatch(keys, ch)
+			return ptl.Reply{}, ctx.Err()
+		}
+	}
+}
+
+// Close rejects the following commands and wakes up the blocked ones, then
+// stops the daemons, takes a final snapshot and closes the log.
+func (e *Engine) Close() error {
+	e.Lock()
+	if e.closed == 1 {
+		e.Unlock()
+		return nil
+	}
+	atomic.StoreInt32(&e.closed, 1)
+	for key := range e.watchers {
+		e.signal(key)
+	}
+	e.Unlock()
+	close(e.stop)
+	if e.storage == nil {
+		return nil
+	}
+	// A filing running meanwhile would move the active db the final
+	// snapshot is written to
+	e.storage.halt()
+	err := e.storage.refresh(e)
+	if closeErr := e.storage.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// watch registers a channel which is notified when one of keys is
+// signaled, e must be locked.
+func (e *Engine) watch(keys []string) chan struct{} {
+	ch := make(chan struct{}, 1)
+	for _, key := range keys {
+		e.watchers[key] = append(e.watchers[key], ch)
+	}
+	return ch
+}
+
+func (e *Engine) unwatch(keys []string, ch chan struct{}) {
+	e.Lock()
+	defer e.Unlock()
+	for _, key := range keys {
+		watchers := e.watchers[key]
+		for i, watcher := range watchers {
+			if watcher == ch {
+				watchers = append(watchers[:i], watchers[i+1:]...)
+				break
+			}
+		}
+		if len(watchers) == 0 {
+			delete(e.watchers, key)
+		} else {
+			e.watchers[key] = watchers
+		}
+	}
+}
+
+// signal wakes up every command blocked on key, e must be locked.
+func (e *Engine) signal(key string) {
+	for _, ch := range e.watchers[key] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+	delete(e.watchers, key)
+}
+
 func (e *Engine) exec(args []string) {
 	if handler, ok := e.handlers[args[0]]; ok {
 		_, _ = handler.handle(e, args)
@@ -79,10 +388,16 @@ func (e *Engine) exec(args []string) {
 }
 
 func (e *Engine) Get(key string) (string, bool) {
+	if e.expired(key) {
+		return "", false
+	}
 	v, ok := e.string.Get(key)
 	if ok {
 		return v.(string), ok
 	}
+	if e.storage == nil || e.inMemory(key) || e.tombstoned(key) {
+		return "", false
+	}
 	v, ok = e.storage.Get(key)
 	if ok {
 		return v.(string), ok
@@ -91,63 +406,230 @@ func (e *Engine) Get(key string) (string, bool) {
 }
 
 func (e *Engine) Set(key, value string, ex time.Duration, nx bool) bool {
-	if nx {
-		return e.string.SetNX(key, value)
+	at := int64(0)
+	if ex > 0 {
+		at = now() + int64(ex/time.Millisecond)
+	}
+	return e.setString(key, value, at, nx)
+}
+
+// setString stores value under key, at is the absolute expiry deadline in unix
+// milliseconds, 0 means the key never expires.
+func (e *Engine) setString(key, value string, at int64, nx bool) bool {
+	t := e.typeOf(key)
+	if nx && t != typeNone {
+		return false
+	}
+	if t != typeString {
+		e.Del(key)
+	}
+	e.store(e.string, key, value)
+	if at > 0 {
+		e.expire.Set(key, at)
+	} else {
+		e.expire.Del(key)
 	}
-	e.string.Set(key, value)
 	return true
 }
 
+// Del deletes key from memory. A tombstone is left if a db file may still
+// hold the key, so that the values archived dbs hold for it stay hidden: the
+// keys which aren't fresh may be in the last snapshot, which is archived when
+// the active db is filed.
 func (e *Engine) Del(key string) bool {
-	return e.string.LogicDel(key)
+	expired := e.expired(key)
+	e.expire.Del(key)
+	deleted := false
+	for _, space := range e.spaces() {
+		deleted = space.Del(key) || deleted
+	}
+	e.index.delete(float64(keyHash(key)), key)
+	if e.archiving() && !e.tombstoned(key) && ((deleted && !e.fresh[key]) || e.storage.holds(key)) {
+		e.tombstone.Set(key, true)
+	}
+	delete(e.fresh, key)
+	return deleted && !expired
+}
+
+// MarshalTo streams a point-in-time snapshot of e to writer. Only taking
+// the snapshot locks e, writers go on while it is written.
+func (e *Engine) MarshalTo(writer io.Writer) error {
+	e.Lock()
+	snap := e.capture()
+	e.Unlock()
+	defer func() {
+		e.Lock()
+		e.release()
+		e.Unlock()
+	}()
+	return snap.marshalTo(writer)
 }
 
 func (e *Engine) Marshal() []byte {
 	buf := &bytes.Buffer{}
-	// Marshal string
-	stringBuf := &bytes.Buffer{}
-	e.string.Foreach(func(e *hashmap.Entry) {
-		key, value := e.Key().(string), e.Value().(string)
-		_ = ptl.WriteUint16(stringBuf, uint16(len(key)))
-		stringBuf.WriteString(key)
-		_ = ptl.WriteUint64(stringBuf, uint64(len(value)))
-		stringBuf.WriteString(value)
-	})
-	_ = ptl.WriteUint64(buf, e.lsn)
-	_ = ptl.WriteUint16(buf, 6)
-	buf.WriteString("string")
-	_ = ptl.WriteUint64(buf, uint64(stringBuf.Len()))
-	buf.Write(stringBuf.Bytes())
+	_ = e.MarshalTo(buf)
 	return buf.Bytes()
 }
 
 func (e *Engine) UnMarshal(reader io.Reader) error {
-	lsn, err := ptl.ReadUint64(reader)
+	r := bufio.NewReader(reader)
+	versioned, err := readHeader(r, dbMagic)
 	if err != nil {
 		return err
 	}
-	typeSize, err := ptl.ReadUint16(reader)
-	if err != nil {
-		return err
+	if !versioned {
+		return e.unMarshalUnversioned(r)
 	}
-	typeBytes, err := ptl.ReadBytes(reader, int(typeSize))
+	lsnData, err := ptl.ReadBytes(r, 8)
 	if err != nil {
-		return err
+		return CorruptedDBError
 	}
-	dataSize, err := ptl.ReadUint64(reader)
+	sum, err := ptl.ReadUint32(r)
+	if err != nil || sum != ptl.Checksum(lsnData) {
+		return CorruptedDBError
+	}
+	for {
+		section := &bytes.Buffer{}
+		tee := io.TeeReader(r, section)
+		typeSize, err := ptl.ReadUint16(tee)
+		if err != nil {
+			return CorruptedDBError
+		}
+		if typeSize == 0 {
+			break
+		}
+		typeBytes, err := ptl.ReadBytes(tee, int(typeSize))
+		if err != nil {
+			return CorruptedDBError
+		}
+		dataSize, err := ptl.ReadUint64(tee)
+		if err != nil {
+			return CorruptedDBError
+		}
+		_, err = io.CopyN(section, r, int64(dataSize))
+		if err != nil {
+			return fmt.Errorf("%w section %s", CorruptedDBError, typeBytes)
+		}
+		sum, err := ptl.ReadUint32(r)
+		if err != nil || sum != ptl.Checksum(section.Bytes()) {
+			return fmt.Errorf("%w section %s", CorruptedDBError, typeBytes)
+		}
+		data := bytes.NewReader(section.Bytes()[section.Len()-int(dataSize):])
+		err = e.unMarshalSection(string(typeBytes), data, dataSize)
+		if err != nil {
+			return err
+		}
+	}
+	e.lsn = binary.BigEndian.Uint64(lsnData)
+	return nil
+}
+
+// unMarshalUnversioned reads a db file written before the format carried a
+// header and checksums.
+func (e *Engine) unMarshalUnversioned(reader io.Reader) error {
+	lsn, err := ptl.ReadUint64(reader)
 	if err != nil {
 		return err
 	}
-	switch string(typeBytes) {
-	case "string":
-		str := hashmap.New()
-		readSize := 0
-		for readSize < int(dataSize) {
-			keySize, err := ptl.ReadUint16(reader)
+	for {
+		typeSize, err := ptl.ReadUint16(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		typeBytes, err := ptl.ReadBytes(reader, int(typeSize))
+		if err != nil {
+			return err
+		}
+		dataSize, err := ptl.ReadUint64(reader)
+		if err != nil {
+			return err
+		}
+		err = e.unMarshalSection(string(typeBytes), reader, dataSize)
+		if err != nil {
+			return err
+		}
+	}
+	e.lsn = lsn
+	return nil
+}
+
+func (e *Engine) unMarshalSection(name string, reader io.Reader, dataSize uint64) error {
+	switch name {
+	case typeString:
+		return e.unMarshalString(reader, dataSize)
+	case typeHash:
+		return e.unMarshalHash(reader, dataSize)
+	case typeList:
+		return e.unMarshalList(reader, dataSize)
+	case typeZSet:
+		return e.unMarshalZSet(reader, dataSize)
+	case typeSet:
+		return e.unMarshalSet(reader, dataSize)
+	case "expire":
+		return e.unMarshalExpire(reader, dataSize)
+	case "tombstone":
+		return e.unMarshalTombstone(reader, dataSize)
+	case "compacted":
+		e.compacted = true
+	}
+	_, err := io.CopyN(ioutil.Discard, reader, int64(dataSize))
+	return err
+}
+
+func (e *Engine) unMarshalString(reader io.Reader, dataSize uint64) error {
+	str := hashmap.New()
+	readSize := 0
+	for readSize < int(dataSize) {
+		keySize, err := ptl.ReadUint16(reader)
+		if err != nil {
+			return err
+		}
+		keyData, err := ptl.ReadBytes(reader, int(keySize))
+		if err != nil {
+			return err
+		}
+		valueSize, err := ptl.ReadUint64(reader)
+		if err != nil {
+			return err
+		}
+		valueData, err := ptl.ReadBytes(reader, int(valueSize))
+		if err != nil {
+			return err
+		}
+		str.Set(string(keyData), string(valueData))
+		readSize += 2 + 8 + int(keySize) + int(valueSize)
+	}
+	e.string = str
+	return nil
+}
+
+func (e *Engine) unMarshalHash(reader io.Reader, dataSize uint64) error {
+	hash := hashmap.New()
+	readSize := 0
+	for readSize < int(dataSize) {
+		keySize, err := ptl.ReadUint16(reader)
+		if err != nil {
+			return err
+		}
+		keyData, err := ptl.ReadBytes(reader, int(keySize))
+		if err != nil {
+			return err
+		}
+		count, err := ptl.ReadUint32(reader)
+		if err != nil {
+			return err
+		}
+		readSize += 2 + 4 + int(keySize)
+		fields := make(map[string]string, count)
+		for i := 0; i < int(count); i++ {
+			fieldSize, err := ptl.ReadUint32(reader)
 			if err != nil {
 				return err
 			}
-			keyData, err := ptl.ReadBytes(reader, int(keySize))
+			fieldData, err := ptl.ReadBytes(reader, int(fieldSize))
 			if err != nil {
 				return err
 			}
@@ -159,11 +641,165 @@ func (e *Engine) UnMarshal(reader io.Reader) error {
 			if err != nil {
 				return err
 			}
-			str.Set(string(keyData), string(valueData))
-			readSize += 2 + 8 + int(keySize) + int(valueSize)
+			fields[string(fieldData)] = string(valueData)
+			readSize += 4 + 8 + int(fieldSize) + int(valueSize)
 		}
-		e.string = str
+		hash.Set(string(keyData), fields)
 	}
-	e.lsn = lsn
+	e.hash = hash
+	return nil
+}
+
+func (e *Engine) unMarshalList(reader io.Reader, dataSize uint64) error {
+	lists := hashmap.New()
+	readSize := 0
+	for readSize < int(dataSize) {
+		keySize, err := ptl.ReadUint16(reader)
+		if err != nil {
+			return err
+		}
+		keyData, err := ptl.ReadBytes(reader, int(keySize))
+		if err != nil {
+			return err
+		}
+		count, err := ptl.ReadUint32(reader)
+		if err != nil {
+			return err
+		}
+		readSize += 2 + 4 + int(keySize)
+		items := list.New()
+		for i := 0; i < int(count); i++ {
+			valueSize, err := ptl.ReadUint64(reader)
+			if err != nil {
+				return err
+			}
+			valueData, err := ptl.ReadBytes(reader, int(valueSize))
+			if err != nil {
+				return err
+			}
+			items.PushBack(string(valueData))
+			readSize += 8 + int(valueSize)
+		}
+		lists.Set(string(keyData), items)
+	}
+	e.list = lists
+	return nil
+}
+
+func (e *Engine) unMarshalZSet(reader io.Reader, dataSize uint64) error {
+	zsets := hashmap.New()
+	readSize := 0
+	for readSize < int(dataSize) {
+		keySize, err := ptl.ReadUint16(reader)
+		if err != nil {
+			return err
+		}
+		keyData, err := ptl.ReadBytes(reader, int(keySize))
+		if err != nil {
+			return err
+		}
+		count, err := ptl.ReadUint32(reader)
+		if err != nil {
+			return err
+		}
+		readSize += 2 + 4 + int(keySize)
+		z := newZSet()
+		for i := 0; i < int(count); i++ {
+			memberSize, err := ptl.ReadUint32(reader)
+			if err != nil {
+				return err
+			}
+			memberData, err := ptl.ReadBytes(reader, int(memberSize))
+			if err != nil {
+				return err
+			}
+			score, err := ptl.ReadUint64(reader)
+			if err != nil {
+				return err
+			}
+			z.add(string(memberData), math.Float64frombits(score))
+			readSize += 4 + 8 + int(memberSize)
+		}
+		zsets.Set(string(keyData), z)
+	}
+	e.zset = zsets
+	return nil
+}
+
+func (e *Engine) unMarshalSet(reader io.Reader, dataSize uint64) error {
+	sets := hashmap.New()
+	readSize := 0
+	for readSize < int(dataSize) {
+		keySize, err := ptl.ReadUint16(reader)
+		if err != nil {
+			return err
+		}
+		keyData, err := ptl.ReadBytes(reader, int(keySize))
+		if err != nil {
+			return err
+		}
+		count, err := ptl.ReadUint32(reader)
+		if err != nil {
+			return err
+		}
+		readSize += 2 + 4 + int(keySize)
+		s := newSet()
+		for i := 0; i < int(count); i++ {
+			memberSize, err := ptl.ReadUint32(reader)
+			if err != nil {
+				return err
+			}
+			memberData, err := ptl.ReadBytes(reader, int(memberSize))
+			if err != nil {
+				return err
+			}
+			s.add(string(memberData))
+			readSize += 4 + int(memberSize)
+		}
+		sets.Set(string(keyData), s)
+	}
+	e.set = sets
+	return nil
+}
+
+func (e *Engine) unMarshalExpire(reader io.Reader, dataSize uint64) error {
+	expire := hashmap.New()
+	readSize := 0
+	for readSize < int(dataSize) {
+		keySize, err := ptl.ReadUint16(reader)
+		if err != nil {
+			return err
+		}
+		keyData, err := ptl.ReadBytes(reader, int(keySize))
+		if err != nil {
+			return err
+		}
+		at, err := ptl.ReadUint64(reader)
+		if err != nil {
+			return err
+		}
+		expire.Set(string(keyData), int64(at))
+		readSize += 2 + 8 + int(keySize)
+	}
+	e.expire = expire
+	return nil
+}
+
+func (e *Engine) unMarshalTombstone(reader io.Reader, dataSize uint64) error {
+	tombstone := hashmap.New()
+	readSize := 0
+	for readSize < int(dataSize) {
+		keySize, err := ptl.ReadUint16(reader)
+		if err != nil {
+			return err
+		}
+		keyData, err := ptl.ReadBytes(reader, int(keySize))
+		if err != nil {
+			return err
+		}
+		tombstone.Set(string(keyData), true)
+		readSize += 2 + int(keySize)
+	}
+	e.tombstone = tombstone
 	return nil
 }
@@ -0,0 +1,215 @@
+package engine
+
+import (
+	"github.com/awesome-cap/hashmap"
+	"github.com/awesome-cap/kv/ptl"
+	"math"
+	"strconv"
+	"time"
+)
+
+const expireInterval = time.Second
+
+var (
+	Expire    = expireHandler{unit: time.Second}
+	PExpire   = expireHandler{unit: time.Millisecond}
+	ExpireAt  = expireHandler{unit: time.Second, at: true}
+	PExpireAt = expireHandler{unit: time.Millisecond, at: true}
+	TTL       = ttlHandler{unit: time.Second}
+	PTTL      = ttlHandler{unit: time.Millisecond}
+	Persist   = persistHandler{}
+)
+
+// now returns the current unix time in milliseconds, all expiry deadlines
+// are stored in this unit.
+func now() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// expired reports whether key has a deadline in the past. Expiry is frozen
+// while the engine is loading, so that replaying the redo log sees the same
+// keys the original commands did.
+func (e *Engine) expired(key string) bool {
+	if e.loading {
+		return false
+	}
+	v, ok := e.expire.Get(key)
+	return ok && v.(int64) <= now()
+}
+
+// exists reports whether key is live, in memory or in an archived db.
+func (e *Engine) exists(key string) bool {
+	return e.keyType(key) != typeNone
+}
+
+// ExpireAt sets the deadline of key to at (unix milliseconds).
+func (e *Engine) ExpireAt(key string, at int64) bool {
+	if !e.exists(key) {
+		return false
+	}
+	e.expire.Set(key, at)
+	return true
+}
+
+// TTL returns the remaining time to live of key in milliseconds, -1 if the
+// key has no deadline and -2 if the key does not exist.
+func (e *Engine) TTL(key string) int64 {
+	if !e.exists(key) {
+		return -2
+	}
+	v, ok := e.expire.Get(key)
+	if !ok {
+		return -1
+	}
+	return v.(int64) - now()
+}
+
+func (e *Engine) Persist(key string) bool {
+	if !e.exists(key) {
+		return false
+	}
+	return e.expire.Del(key)
+}
+
+func (e *Engine) startDaemon() {
+	// Expire keys
+	go func() {
+		ticker := time.NewTicker(expireInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-e.stop:
+				return
+			case <-ticker.C:
+				e.sweep()
+			}
+		}
+	}()
+}
+
+func (e *Engine) sweep() {
+	e.Lock()
+	defer e.Unlock()
+	// The dels are not fsynced: if they are lost, so are the writes which
+	// followed them, and the keys expire again after a restart.
+	if e.closed == 1 || e.storage.health.degraded() {
+		return
+	}
+	keys := make([]string, 0)
+	deadline := now()
+	e.expire.Foreach(func(entry *hashmap.Entry) {
+		if entry.Value().(int64) <= deadline {
+			keys = append(keys, entry.Key().(string))
+		}
+	})
+	_ = e.purge(keys)
+}
+
+// purge deletes the expired keys among keys, logging a del for each first.
+// Replaying the log doesn't expire keys, so it has to see the deletes the
+// following commands saw. e must be locked.
+func (e *Engine) purge(keys []string) error {
+	for _, key := range keys {
+		if !e.expired(key) {
+			continue
+		}
+		lsn, err := e.storage.logging([]string{Del.name(), key})
+		if err != nil {
+			return err
+		}
+		e.lsn = lsn
+		e.Del(key)
+	}
+	return nil
+}
+
+type expireHandler struct {
+	unit time.Duration
+	at   bool
+}
+
+// deadline converts the timeout arg into an absolute deadline in unix
+// milliseconds.
+func (h expireHandler) deadline(arg string) (int64, error) {
+	i, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return 0, NotIntegerError
+	}
+	unit := int64(h.unit / time.Millisecond)
+	if i > math.MaxInt64/unit || i < math.MinInt64/unit {
+		return 0, InvalidExpireError
+	}
+	at := i * unit
+	if !h.at {
+		if at > math.MaxInt64-now() {
+			return 0, InvalidExpireError
+		}
+		at += now()
+	}
+	return at, nil
+}
+
+// rewrite logs relative timeouts as pexpireat, replaying them later must
+// not push the deadline back.
+func (h expireHandler) rewrite(e *Engine, args []string) ([]string, error) {
+	at, err := h.deadline(args[2])
+	if err != nil {
+		return nil, err
+	}
+	return []string{PExpireAt.name(), args[1], strconv.FormatInt(at, 10)}, nil
+}
+
+func (h expireHandler) handle(e *Engine, args []string) (ptl.Reply, error) {
+	at, err := h.deadline(args[2])
+	if err != nil {
+		return ptl.Reply{}, err
+	}
+	if e.ExpireAt(args[1], at) {
+		return ptl.Integer(1), nil
+	}
+	return ptl.Integer(0), nil
+}
+
+func (h expireHandler) size() int { return 3 }
+func (h expireHandler) name() string {
+	name := "expire"
+	if h.unit == time.Millisecond {
+		name = "p" + name
+	}
+	if h.at {
+		name += "at"
+	}
+	return name
+}
+
+type ttlHandler struct {
+	unit time.Duration
+}
+
+func (h ttlHandler) handle(e *Engine, args []string) (ptl.Reply, error) {
+	ttl := e.TTL(args[1])
+	if ttl > 0 && h.unit == time.Second {
+		ttl = (ttl + 500) / 1000
+	}
+	return ptl.Integer(ttl), nil
+}
+
+func (h ttlHandler) size() int { return 2 }
+func (h ttlHandler) name() string {
+	if h.unit == time.Millisecond {
+		return "pttl"
+	}
+	return "ttl"
+}
+
+type persistHandler struct{}
+
+func (h persistHandler) handle(e *Engine, args []string) (ptl.Reply, error) {
+	if e.Persist(args[1]) {
+		return ptl.Integer(1), nil
+	}
+	return ptl.Integer(0), nil
+}
+
+func (h persistHandler) size() int    { return 2 }
+func (h persistHandler) name() string { return "persist" }
@@ -0,0 +1,122 @@
+package engine
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestExpire(t *testing.T) {
+	dir := t.TempDir()
+	e := openEngine(t, dir, true)
+	exec(t, e, "set", "k", "v")
+	exec(t, e, "hset", "h", "f", "v")
+	if v := exec(t, e, "ttl", "k")[0]; v != "-1" {
+		t.Fatalf("ttl: want -1, got %s", v)
+	}
+	if v := exec(t, e, "ttl", "missing")[0]; v != "-2" {
+		t.Fatalf("ttl missing: want -2, got %s", v)
+	}
+	if v := exec(t, e, "expire", "missing", "10")[0]; v != "0" {
+		t.Fatalf("expire missing: want 0, got %s", v)
+	}
+	if v := exec(t, e, "expire", "k", "100")[0]; v != "1" {
+		t.Fatalf("expire: want 1, got %s", v)
+	}
+	if v := exec(t, e, "ttl", "k")[0]; v != "100" {
+		t.Fatalf("ttl: want 100, got %s", v)
+	}
+	if v, _ := strconv.Atoi(exec(t, e, "pttl", "k")[0]); v <= 99000 || v > 100000 {
+		t.Fatalf("pttl: want about 100000, got %d", v)
+	}
+	exec(t, e, "pexpireat", "h", strconv.FormatInt(now()+50000, 10))
+	if v := exec(t, e, "ttl", "h")[0]; v != "50" {
+		t.Fatalf("ttl h: want 50, got %s", v)
+	}
+	if v := exec(t, e, "persist", "h")[0]; v != "1" {
+		t.Fatalf("persist: want 1, got %s", v)
+	}
+	if v := exec(t, e, "persist", "h")[0]; v != "0" {
+		t.Fatalf("persist again: want 0, got %s", v)
+	}
+	if _, err := e.Exec([]string{"expire", "k", "x"}); err != NotIntegerError {
+		t.Fatalf("expire x: want NotIntegerError, got %v", err)
+	}
+
+	// A deadline in the past deletes the key
+	exec(t, e, "set", "past", "v")
+	exec(t, e, "expireat", "past", "1")
+	assertGet(t, e, "past", "", false)
+	exec(t, e, "set", "negative", "v")
+	exec(t, e, "expire", "negative", "-1")
+	assertGet(t, e, "negative", "", false)
+
+	// Overwriting a key drops its deadline, unless SET gives a new one
+	exec(t, e, "set", "over", "v", "px", "1")
+	exec(t, e, "set", "over", "w")
+	time.Sleep(5 * time.Millisecond)
+	assertGet(t, e, "over", "w", true)
+
+	// Replay keeps the deadlines the relative timeouts had
+	exec(t, e, "pexpire", "short", "1")
+	exec(t, e, "set", "short", "v")
+	exec(t, e, "pexpire", "short", "1")
+	time.Sleep(5 * time.Millisecond)
+	e = openEngine(t, dir, true)
+	if v, _ := strconv.Atoi(exec(t, e, "ttl", "k")[0]); v < 99 || v > 100 {
+		t.Fatalf("ttl after restart: want 100, got %d", v)
+	}
+	if v := exec(t, e, "ttl", "h")[0]; v != "-1" {
+		t.Fatalf("ttl h after restart: want -1, got %s", v)
+	}
+	assertGet(t, e, "short", "", false)
+	assertGet(t, e, "past", "", false)
+	assertGet(t, e, "over", "w", true)
+}
+
+func TestExpireArchived(t *testing.T) {
+	dir := t.TempDir()
+	// The string only lives in the older archive, the newest one is loaded
+	// into memory
+	a := newEngine()
+	a.Registry(Set)
+	a.exec([]string{"set", "old", "v"})
+	b := newEngine()
+	b.Registry(HSet)
+	b.exec([]string{"hset", "h", "f", "v"})
+	for i, archived := range []*Engine{a, b} {
+		path := filepath.Join(dir, "s_"+strconv.Itoa(i+1)+".db")
+		if err := ioutil.WriteFile(path, marshalSorted(t, archived), 0766); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e := openEngine(t, dir, true)
+	assertGet(t, e, "old", "v", true)
+	for _, c := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"ttl", "old"}, "-1"},
+		{[]string{"expire", "old", "100"}, "1"},
+		{[]string{"ttl", "old"}, "100"},
+		{[]string{"persist", "old"}, "1"},
+		{[]string{"ttl", "old"}, "-1"},
+		{[]string{"msetnx", "old", "x", "new", "y"}, "0"},
+		{[]string{"pexpire", "old", "1"}, "1"},
+	} {
+		if got := exec(t, e, c.args...)[0]; got != c.want {
+			t.Fatalf("%v: want %s, got %s", c.args, c.want, got)
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+	assertGet(t, e, "old", "", false)
+	if v := exec(t, e, "ttl", "old")[0]; v != "-2" {
+		t.Fatalf("ttl expired: want -2, got %s", v)
+	}
+
+	e = openEngine(t, dir, true)
+	assertGet(t, e, "old", "", false)
+	assertGet(t, e, "new", "", false)
+}
@@ -0,0 +1,103 @@
+package engine
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"github.com/awesome-cap/kv/ptl"
+	"io"
+)
+
+// Db files and log segments start with a magic and the format version, files
+// without them are read in the unversioned format of older releases.
+const (
+	dbMagic       = "KVDB"
+	logMagic      = "KVLG"
+	formatVersion = 1
+	headerSize    = 6
+)
+
+var (
+	CorruptedDBError        = errors.New("Corrupted db file. ")
+	CorruptedLogError       = errors.New("Corrupted log file. ")
+	UnsupportedVersionError = errors.New("Unsupported file version. ")
+)
+
+func writeHeader(writer io.Writer, magic string) error {
+	_, err := io.WriteString(writer, magic)
+	if err != nil {
+		return err
+	}
+	return ptl.WriteUint16(writer, formatVersion)
+}
+
+// readHeader consumes the header of a versioned file and reports false for
+// an unversioned one, which is left unread.
+func readHeader(reader *bufio.Reader, magic string) (bool, error) {
+	header, err := reader.Peek(headerSize)
+	if err != nil || string(header[:len(magic)]) != magic {
+		return false, nil
+	}
+	if binary.BigEndian.Uint16(header[len(magic):]) != formatVersion {
+		return true, UnsupportedVersionError
+	}
+	_, err = reader.Discard(headerSize)
+	return true, err
+}
+
+// zeroed reports whether the rest of reader holds nothing but zeros, which is
+// what a write torn by a crash leaves at the end of a file.
+func zeroed(reader io.Reader) bool {
+	buf := make([]byte, 4096)
+	for {
+		n, err := reader.Read(buf)
+		for _, b := range buf[:n] {
+			if b != 0 {
+				return false
+			}
+		}
+		if err == io.EOF {
+			return true
+		}
+		if err != nil {
+			return false
+		}
+	}
+}
+
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+// errWriter keeps the first error of writer and skips the writes after it.
+type errWriter struct {
+	io.Writer
+	err error
+}
+
+func (w *errWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n, err := w.Writer.Write(p)
+	if err != nil {
+		w.err = err
+	}
+	return n, err
+}
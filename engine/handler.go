@@ -3,25 +3,79 @@ package engine
 import (
 	"errors"
 	"fmt"
+	"github.com/awesome-cap/kv/ptl"
+	"math"
+	"strconv"
 	"strings"
+	"time"
 )
 
 var (
-	Get = getHandler{}
-	Set = setHandler{}
-	Del = delHandler{}
+	Get         = getHandler{}
+	Set         = setHandler{}
+	Del         = delHandler{}
+	Incr        = incrHandler{sign: 1}
+	Decr        = incrHandler{sign: -1}
+	IncrBy      = incrHandler{sign: 1, by: true}
+	DecrBy      = incrHandler{sign: -1, by: true}
+	IncrByFloat = incrbyfloatHandler{}
+	Append      = appendHandler{}
+	GetSet      = getsetHandler{}
+	GetDel      = getdelHandler{}
+	SetRange    = setrangeHandler{}
+	GetRange    = getrangeHandler{}
+	StrLen      = strlenHandler{}
+	MGet        = mgetHandler{}
+	MSet        = msetHandler{}
+	MSetNX      = msetHandler{nx: true}
 
 	writeable = map[string]bool{
 		"set": true, "del": true,
+		"incr": true, "decr": true, "incrby": true, "decrby": true, "incrbyfloat": true,
+		"append": true, "getset": true, "getdel": true, "setrange": true, "mset": true, "msetnx": true,
+		"expire": true, "pexpire": true, "expireat": true, "pexpireat": true, "persist": true,
+		"hset": true, "hdel": true, "hincrby": true,
+		"lpush": true, "rpush": true, "lpop": true, "rpop": true, "ltrim": true, "blpop": true, "brpop": true,
+		"zadd": true, "zrem": true, "zincrby": true,
+		"sadd": true, "srem": true, "spop": true, "sinterstore": true, "sunionstore": true, "sdiffstore": true,
+		"rename": true, "renamenx": true,
 	}
+
+	SyntaxError     = errors.New("Syntax error. ")
+	NotIntegerError = errors.New("Value is not an integer or out of range. ")
+	WrongTypeError  = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value. ")
+
+	IncrOverflowError   = errors.New("Increment or decrement would overflow. ")
+	IncrNaNOrInfError   = errors.New("Increment would produce NaN or Infinity. ")
+	OffsetOutRangeError = errors.New("Offset is out of range. ")
+	StringTooLongError  = errors.New("String exceeds maximum allowed size. ")
+	InvalidExpireError  = errors.New("Invalid expire time. ")
+
+	blockedError = errors.New("Blocked. ")
 )
 
 type handler interface {
-	handle(e *Engine, args []string) ([]string, error)
+	handle(e *Engine, args []string) (ptl.Reply, error)
 	size() int
 	name() string
 }
 
+// rewriter is implemented by handlers whose args depend on the time or the
+// state they are executed in. The rewritten args are what gets logged and
+// executed, so that replaying the redo log is deterministic.
+type rewriter interface {
+	rewrite(e *Engine, args []string) ([]string, error)
+}
+
+// blocker is implemented by write handlers which wait for the given keys to
+// be signaled, while rewrite fails with blockedError, or until timeout.
+type blocker interface {
+	rewriter
+	handler
+	keys(args []string) []string
+	timeout(args []string) (time.Duration, error)
+}
+
 func assertArgsSize(args []string, s int) error {
 	if len(args) < s {
 		return errors.New(fmt.Sprintf("Args size err, expect %d", s))
@@ -31,11 +85,14 @@ func assertArgsSize(args []string, s int) error {
 
 type getHandler struct{}
 
-func (h getHandler) handle(e *Engine, args []string) ([]string, error) {
+func (h getHandler) handle(e *Engine, args []string) (ptl.Reply, error) {
+	if err := e.assertType(args[1], typeString); err != nil {
+		return ptl.Reply{}, err
+	}
 	if v, ok := e.Get(args[1]); ok {
-		return []string{v}, nil
+		return ptl.Bulk(v), nil
 	}
-	return []string{""}, nil
+	return ptl.Nil(), nil
 }
 
 func (h getHandler) size() int    { return 2 }
@@ -43,17 +100,78 @@ func (h getHandler) name() string { return "get" }
 
 type setHandler struct{}
 
-func (h setHandler) handle(e *Engine, args []string) ([]string, error) {
-	nx := false
+// options parses NX, EX seconds, PX milliseconds, EXAT timestamp and PXAT
+// milliseconds-timestamp, the deadline is returned in unix milliseconds.
+func (h setHandler) options(args []string) (nx bool, at int64, err error) {
 	for i := 3; i < len(args); i++ {
-		if strings.ToUpper(args[i]) == "NX" {
+		option := strings.ToUpper(args[i])
+		switch option {
+		case "NX":
 			nx = true
+		case "EX", "PX", "EXAT", "PXAT":
+			if i+1 >= len(args) || at != 0 {
+				return false, 0, SyntaxError
+			}
+			i++
+			at, err = strconv.ParseInt(args[i], 10, 64)
+			if err != nil || at <= 0 {
+				return false, 0, NotIntegerError
+			}
+			at, err = absolute(at, option)
+			if err != nil {
+				return false, 0, err
+			}
+		default:
+			return false, 0, SyntaxError
 		}
 	}
-	if e.Set(args[1], args[2], 0, nx) {
-		return []string{"1"}, nil
+	return nx, at, nil
+}
+
+// absolute converts the timeout of a SET option into a deadline in unix
+// milliseconds, failing if it overflows.
+func absolute(timeout int64, option string) (int64, error) {
+	if option == "EX" || option == "EXAT" {
+		if timeout > math.MaxInt64/1000 {
+			return 0, InvalidExpireError
+		}
+		timeout *= 1000
+	}
+	if option == "EXAT" || option == "PXAT" {
+		return timeout, nil
+	}
+	n := now()
+	if timeout > math.MaxInt64-n {
+		return 0, InvalidExpireError
+	}
+	return n + timeout, nil
+}
+
+func (h setHandler) rewrite(e *Engine, args []string) ([]string, error) {
+	nx, at, err := h.options(args)
+	if err != nil {
+		return nil, err
+	}
+	rewritten := []string{args[0], args[1], args[2]}
+	if nx {
+		rewritten = append(rewritten, "NX")
+	}
+	if at > 0 {
+		rewritten = append(rewritten, "PXAT", strconv.FormatInt(at, 10))
+	}
+	return rewritten, nil
+}
+
+func (h setHandler) handle(e *Engine, args []string) (ptl.Reply, error) {
+	nx, at, err := h.options(args)
+	if err != nil {
+		return ptl.Reply{}, err
+	}
+	if e.setString(args[1], args[2], at, nx) {
+		return ptl.OK(), nil
 	}
-	return []string{"0"}, nil
+	// The key exists and NX was given
+	return ptl.Nil(), nil
 }
 
 func (h setHandler) size() int    { return 3 }
@@ -61,12 +179,324 @@ func (h setHandler) name() string { return "set" }
 
 type delHandler struct{}
 
-func (h delHandler) handle(e *Engine, args []string) ([]string, error) {
-	if e.Del(args[1]) {
-		return []string{"1"}, nil
+func (h delHandler) handle(e *Engine, args []string) (ptl.Reply, error) {
+	deleted := 0
+	for _, key := range args[1:] {
+		if e.keyType(key) != typeNone {
+			deleted++
+		}
+		e.Del(key)
 	}
-	return []string{"0"}, nil
+	return ptl.Integer(int64(deleted)), nil
 }
 
 func (h delHandler) size() int    { return 2 }
 func (h delHandler) name() string { return "del" }
+
+// maxStringSize bounds the strings SETRANGE and APPEND can grow.
+const maxStringSize = 512 * 1024 * 1024
+
+// stringOf returns the string stored at key, failing if the key holds a
+// value of another type.
+func (e *Engine) stringOf(key string) (string, bool, error) {
+	err := e.assertType(key, typeString)
+	if err != nil {
+		return "", false, err
+	}
+	v, ok := e.Get(key)
+	return v, ok, nil
+}
+
+// update replaces the value of a string key, keeping its deadline if the
+// key exists.
+func (e *Engine) update(key, value string) {
+	if e.exists(key) {
+		e.string.Set(key, value)
+		return
+	}
+	e.setString(key, value, 0, false)
+}
+
+func incrBy(value, incr int64) (int64, error) {
+	if (incr > 0 && value > math.MaxInt64-incr) || (incr < 0 && value < math.MinInt64-incr) {
+		return 0, IncrOverflowError
+	}
+	return value + incr, nil
+}
+
+type incrHandler struct {
+	sign int64
+	by   bool
+}
+
+func (h incrHandler) handle(e *Engine, args []string) (ptl.Reply, error) {
+	incr := int64(1)
+	if h.by {
+		var err error
+		incr, err = strconv.ParseInt(args[2], 10, 64)
+		if err != nil || (h.sign < 0 && incr == math.MinInt64) {
+			return ptl.Reply{}, NotIntegerError
+		}
+	}
+	v, ok, err := e.stringOf(args[1])
+	if err != nil {
+		return ptl.Reply{}, err
+	}
+	value := int64(0)
+	if ok {
+		value, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return ptl.Reply{}, NotIntegerError
+		}
+	}
+	value, err = incrBy(value, h.sign*incr)
+	if err != nil {
+		return ptl.Reply{}, err
+	}
+	e.update(args[1], strconv.FormatInt(value, 10))
+	return ptl.Integer(value), nil
+}
+
+func (h incrHandler) size() int {
+	if h.by {
+		return 3
+	}
+	return 2
+}
+
+func (h incrHandler) name() string {
+	name := "incr"
+	if h.sign < 0 {
+		name = "decr"
+	}
+	if h.by {
+		name += "by"
+	}
+	return name
+}
+
+type incrbyfloatHandler struct{}
+
+func (h incrbyfloatHandler) handle(e *Engine, args []string) (ptl.Reply, error) {
+	incr, err := strconv.ParseFloat(args[2], 64)
+	if err != nil {
+		return ptl.Reply{}, NotFloatError
+	}
+	v, ok, err := e.stringOf(args[1])
+	if err != nil {
+		return ptl.Reply{}, err
+	}
+	value := float64(0)
+	if ok {
+		value, err = strconv.ParseFloat(v, 64)
+		if err != nil {
+			return ptl.Reply{}, NotFloatError
+		}
+	}
+	value += incr
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return ptl.Reply{}, IncrNaNOrInfError
+	}
+	v = strconv.FormatFloat(value, 'f', -1, 64)
+	e.update(args[1], v)
+	return ptl.Double(v), nil
+}
+
+func (h incrbyfloatHandler) size() int    { return 3 }
+func (h incrbyfloatHandler) name() string { return "incrbyfloat" }
+
+type appendHandler struct{}
+
+func (h appendHandler) handle(e *Engine, args []string) (ptl.Reply, error) {
+	v, _, err := e.stringOf(args[1])
+	if err != nil {
+		return ptl.Reply{}, err
+	}
+	if len(v)+len(args[2]) > maxStringSize {
+		return ptl.Reply{}, StringTooLongError
+	}
+	v += args[2]
+	e.update(args[1], v)
+	return ptl.Integer(int64(len(v))), nil
+}
+
+func (h appendHandler) size() int    { return 3 }
+func (h appendHandler) name() string { return "append" }
+
+type getsetHandler struct{}
+
+func (h getsetHandler) handle(e *Engine, args []string) (ptl.Reply, error) {
+	v, ok, err := e.stringOf(args[1])
+	if err != nil {
+		return ptl.Reply{}, err
+	}
+	e.setString(args[1], args[2], 0, false)
+	if !ok {
+		return ptl.Nil(), nil
+	}
+	return ptl.Bulk(v), nil
+}
+
+func (h getsetHandler) size() int    { return 3 }
+func (h getsetHandler) name() string { return "getset" }
+
+type getdelHandler struct{}
+
+func (h getdelHandler) handle(e *Engine, args []string) (ptl.Reply, error) {
+	v, ok, err := e.stringOf(args[1])
+	if err != nil {
+		return ptl.Reply{}, err
+	}
+	if !ok {
+		return ptl.Nil(), nil
+	}
+	e.Del(args[1])
+	return ptl.Bulk(v), nil
+}
+
+func (h getdelHandler) size() int    { return 2 }
+func (h getdelHandler) name() string { return "getdel" }
+
+type setrangeHandler struct{}
+
+func (h setrangeHandler) offset(args []string) (int, error) {
+	offset, err := strconv.Atoi(args[2])
+	if err != nil || offset < 0 {
+		return 0, OffsetOutRangeError
+	}
+	// Compared this way round, so that a large offset can't overflow
+	if offset > maxStringSize-len(args[3]) {
+		return 0, StringTooLongError
+	}
+	return offset, nil
+}
+
+// rewrite validates the args before they are logged, invalid ones would fail
+// again on every replay.
+func (h setrangeHandler) rewrite(e *Engine, args []string) ([]string, error) {
+	_, err := h.offset(args)
+	if err != nil {
+		return nil, err
+	}
+	return args, nil
+}
+
+func (h setrangeHandler) handle(e *Engine, args []string) (ptl.Reply, error) {
+	offset, err := h.offset(args)
+	if err != nil {
+		return ptl.Reply{}, err
+	}
+	v, _, err := e.stringOf(args[1])
+	if err != nil {
+		return ptl.Reply{}, err
+	}
+	if len(args[3]) == 0 {
+		return ptl.Integer(int64(len(v))), nil
+	}
+	data := []byte(v)
+	if end := offset + len(args[3]); end > len(data) {
+		data = append(data, make([]byte, end-len(data))...)
+	}
+	copy(data[offset:], args[3])
+	e.update(args[1], string(data))
+	return ptl.Integer(int64(len(data))), nil
+}
+
+func (h setrangeHandler) size() int    { return 4 }
+func (h setrangeHandler) name() string { return "setrange" }
+
+type getrangeHandler struct{}
+
+func (h getrangeHandler) handle(e *Engine, args []string) (ptl.Reply, error) {
+	start, stop, err := parseRange(args[2:])
+	if err != nil {
+		return ptl.Reply{}, err
+	}
+	v, _, err := e.stringOf(args[1])
+	if err != nil {
+		return ptl.Reply{}, err
+	}
+	start, stop, ok := rangeOf(start, stop, len(v))
+	if !ok {
+		return ptl.Bulk(""), nil
+	}
+	return ptl.Bulk(v[start : stop+1]), nil
+}
+
+func (h getrangeHandler) size() int    { return 4 }
+func (h getrangeHandler) name() string { return "getrange" }
+
+type strlenHandler struct{}
+
+func (h strlenHandler) handle(e *Engine, args []string) (ptl.Reply, error) {
+	v, _, err := e.stringOf(args[1])
+	if err != nil {
+		return ptl.Reply{}, err
+	}
+	return ptl.Integer(int64(len(v))), nil
+}
+
+func (h strlenHandler) size() int    { return 2 }
+func (h strlenHandler) name() string { return "strlen" }
+
+type mgetHandler struct{}
+
+func (h mgetHandler) handle(e *Engine, args []string) (ptl.Reply, error) {
+	results := make([]ptl.Reply, len(args)-1)
+	for i, key := range args[1:] {
+		results[i] = ptl.Nil()
+		// Keys holding other types are reported as missing
+		if t := e.typeOf(key); t == typeString || t == typeNone {
+			if v, ok := e.Get(key); ok {
+				results[i] = ptl.Bulk(v)
+			}
+		}
+	}
+	return ptl.Array(results...), nil
+}
+
+func (h mgetHandler) size() int    { return 2 }
+func (h mgetHandler) name() string { return "mget" }
+
+// msetHandler sets all the given keys as one command, so it's a single
+// record in the redo log and replay never applies part of it.
+type msetHandler struct {
+	nx bool
+}
+
+// rewrite rejects an odd number of args before they are logged, the record
+// would fail again on every replay.
+func (h msetHandler) rewrite(e *Engine, args []string) ([]string, error) {
+	if len(args)%2 != 1 {
+		return nil, SyntaxError
+	}
+	return args, nil
+}
+
+func (h msetHandler) handle(e *Engine, args []string) (ptl.Reply, error) {
+	if len(args)%2 != 1 {
+		return ptl.Reply{}, SyntaxError
+	}
+	if h.nx {
+		for i := 1; i < len(args); i += 2 {
+			if e.exists(args[i]) {
+				return ptl.Integer(0), nil
+			}
+		}
+	}
+	for i := 1; i < len(args); i += 2 {
+		e.setString(args[i], args[i+1], 0, false)
+	}
+	if h.nx {
+		return ptl.Integer(1), nil
+	}
+	return ptl.OK(), nil
+}
+
+func (h msetHandler) size() int { return 3 }
+func (h msetHandler) name() string {
+	if h.nx {
+		return "msetnx"
+	}
+	return "mset"
+}
@@ -0,0 +1,221 @@
+package engine
+
+import (
+	"github.com/awesome-cap/kv/ptl"
+	"testing"
+	"time"
+)
+
+func TestSetRange(t *testing.T) {
+	dir := t.TempDir()
+	e := openEngine(t, dir, true)
+	exec(t, e, "set", "k", "hello")
+	if n := exec(t, e, "setrange", "k", "6", "world")[0]; n != "11" {
+		t.Fatalf("setrange: want 11, got %s", n)
+	}
+	if n := exec(t, e, "setrange", "missing", "0", "")[0]; n != "0" {
+		t.Fatalf("setrange empty: want 0, got %s", n)
+	}
+	for offset, want := range map[string]error{
+		"-1":                  OffsetOutRangeError,
+		"x":                   OffsetOutRangeError,
+		"536870912":           StringTooLongError,
+		"9223372036854775807": StringTooLongError,
+	} {
+		if _, err := e.Exec([]string{"setrange", "k", offset, "x"}); err != want {
+			t.Fatalf("setrange %s: want %v, got %v", offset, want, err)
+		}
+	}
+
+	// The invalid commands were not logged, replay gets the same value
+	e = openEngine(t, dir, true)
+	assertGet(t, e, "k", "hello\x00world", true)
+	assertGet(t, e, "missing", "", false)
+}
+
+func TestSetExpireOverflow(t *testing.T) {
+	e := openEngine(t, t.TempDir(), true)
+	exec(t, e, "set", "k", "v")
+	for _, args := range [][]string{
+		{"set", "k", "v", "ex", "9223372036854775807"},
+		{"set", "k", "v", "px", "9223372036854775807"},
+		{"set", "k", "v", "exat", "9223372036854776"},
+		{"expire", "k", "9223372036854775807"},
+		{"expire", "k", "-9223372036854775808"},
+		{"pexpire", "k", "9223372036854775807"},
+		{"expireat", "k", "9223372036854776"},
+	} {
+		if _, err := e.Exec(args); err != InvalidExpireError {
+			t.Fatalf("%v: want InvalidExpireError, got %v", args, err)
+		}
+	}
+	if v := exec(t, e, "ttl", "k")[0]; v != "-1" {
+		t.Fatalf("ttl: want -1, got %s", v)
+	}
+	exec(t, e, "set", "k", "v", "pxat", "9223372036854775807")
+	exec(t, e, "set", "k", "v", "ex", "9000000000000000")
+	if v := exec(t, e, "ttl", "k")[0]; v == "-1" || v[0] == '-' {
+		t.Fatalf("ttl: want a deadline, got %s", v)
+	}
+}
+
+type panicHandler struct{}
+
+func (h panicHandler) handle(e *Engine, args []string) (ptl.Reply, error) {
+	panic("boom")
+}
+
+func (h panicHandler) size() int    { return 1 }
+func (h panicHandler) name() string { return "boom" }
+
+func TestWritePanicUnlocks(t *testing.T) {
+	e := openEngine(t, t.TempDir(), false)
+	e.Registry(panicHandler{})
+	writeable["boom"] = true
+	defer delete(writeable, "boom")
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("boom: want a panic")
+			}
+		}()
+		_, _ = e.Exec([]string{"boom"})
+	}()
+	// The server recovers the panic, the following writes go on
+	exec(t, e, "set", "k", "v")
+	assertGet(t, e, "k", "v", true)
+}
+
+func TestGetRange(t *testing.T) {
+	e := openEngine(t, t.TempDir(), false)
+	exec(t, e, "set", "k", "Hello")
+	exec(t, e, "set", "empty", "")
+	for _, c := range []struct {
+		key, start, stop string
+		want             string
+	}{
+		{"k", "0", "-1", "Hello"},
+		{"k", "1", "3", "ell"},
+		{"k", "-3", "-2", "ll"},
+		{"k", "-100", "100", "Hello"},
+		{"k", "3", "1", ""},
+		{"k", "5", "10", ""},
+		{"k", "-1", "-2", ""},
+		{"k", "-9223372036854775808", "9223372036854775807", "Hello"},
+		{"empty", "0", "-1", ""},
+		{"missing", "0", "-1", ""},
+	} {
+		if got := exec(t, e, "getrange", c.key, c.start, c.stop); len(got) != 1 || got[0] != c.want {
+			t.Fatalf("getrange %s %s %s: want %q, got %v", c.key, c.start, c.stop, c.want, got)
+		}
+	}
+	if _, err := e.Exec([]string{"getrange", "k", "x", "1"}); err != NotIntegerError {
+		t.Fatalf("getrange x: want NotIntegerError, got %v", err)
+	}
+	exec(t, e, "hset", "h", "f", "v")
+	if _, err := e.Exec([]string{"getrange", "h", "0", "1"}); err != WrongTypeError {
+		t.Fatalf("getrange hash: want WrongTypeError, got %v", err)
+	}
+}
+
+func TestCounters(t *testing.T) {
+	dir := t.TempDir()
+	e := openEngine(t, dir, true)
+	exec(t, e, "incr", "n")
+	exec(t, e, "incrby", "n", "10")
+	exec(t, e, "decrby", "n", "3")
+	if v := exec(t, e, "decr", "n")[0]; v != "7" {
+		t.Fatalf("decr: want 7, got %s", v)
+	}
+	exec(t, e, "set", "max", "9223372036854775807")
+	exec(t, e, "set", "s", "x")
+	exec(t, e, "set", "big", "1e308")
+	for _, c := range []struct {
+		args []string
+		want error
+	}{
+		{[]string{"incr", "max"}, IncrOverflowError},
+		{[]string{"decrby", "n", "-9223372036854775807"}, IncrOverflowError},
+		{[]string{"incr", "s"}, NotIntegerError},
+		{[]string{"incrbyfloat", "s", "1"}, NotFloatError},
+		{[]string{"incrbyfloat", "big", "1e308"}, IncrNaNOrInfError},
+	} {
+		if _, err := e.Exec(c.args); err != c.want {
+			t.Fatalf("%v: want %v, got %v", c.args, c.want, err)
+		}
+	}
+	exec(t, e, "set", "f", "10.5")
+	if v := exec(t, e, "incrbyfloat", "f", "0.1")[0]; v != "10.6" {
+		t.Fatalf("incrbyfloat: want 10.6, got %s", v)
+	}
+	exec(t, e, "set", "ttl", "1", "ex", "100")
+	exec(t, e, "incr", "ttl")
+	exec(t, e, "append", "a", "x")
+	if v := exec(t, e, "append", "a", "yz")[0]; v != "3" {
+		t.Fatalf("append: want 3, got %s", v)
+	}
+	if v := exec(t, e, "getset", "a", "new"); len(v) != 1 || v[0] != "xyz" {
+		t.Fatalf("getset: want xyz, got %v", v)
+	}
+	exec(t, e, "set", "gone", "v")
+	if v := exec(t, e, "getdel", "gone"); len(v) != 1 || v[0] != "v" {
+		t.Fatalf("getdel: want v, got %v", v)
+	}
+	if v := exec(t, e, "strlen", "a")[0]; v != "3" {
+		t.Fatalf("strlen: want 3, got %s", v)
+	}
+
+	// Replay gets the same values, the increment kept the deadline
+	e = openEngine(t, dir, true)
+	assertGet(t, e, "n", "7", true)
+	assertGet(t, e, "f", "10.6", true)
+	assertGet(t, e, "ttl", "2", true)
+	assertGet(t, e, "a", "new", true)
+	assertGet(t, e, "gone", "", false)
+	if v := exec(t, e, "ttl", "ttl")[0]; v == "-1" {
+		t.Fatal("ttl: want the deadline kept")
+	}
+}
+
+func TestMSetNX(t *testing.T) {
+	dir := t.TempDir()
+	e := openEngine(t, dir, true)
+	exec(t, e, "set", "str", "v")
+	exec(t, e, "hset", "h", "f", "v")
+	exec(t, e, "set", "expired", "old", "px", "1")
+	time.Sleep(5 * time.Millisecond)
+
+	// Any existing key, whatever its type, fails the whole command
+	for _, key := range []string{"h", "str"} {
+		if v := exec(t, e, "msetnx", "a", "1", key, "2")[0]; v != "0" {
+			t.Fatalf("msetnx %s: want 0, got %s", key, v)
+		}
+		assertGet(t, e, "a", "", false)
+	}
+	if v := exec(t, e, "msetnx", "a", "1", "b", "2", "expired", "new")[0]; v != "1" {
+		t.Fatalf("msetnx: want 1, got %s", v)
+	}
+	if v := exec(t, e, "msetnx", "c", "1", "c", "2")[0]; v != "1" {
+		t.Fatalf("msetnx duplicate: want 1, got %s", v)
+	}
+	lsn := e.lsn
+	for _, name := range []string{"mset", "msetnx"} {
+		if _, err := e.Exec([]string{name, "d", "1", "e"}); err != SyntaxError {
+			t.Fatalf("%s odd: want SyntaxError, got %v", name, err)
+		}
+	}
+	if e.lsn != lsn {
+		t.Fatalf("lsn: want %d, the odd commands are not logged, got %d", lsn, e.lsn)
+	}
+	if got := exec(t, e, "mget", "a", "h", "missing", "c"); len(got) != 2 || got[0] != "1" || got[1] != "2" {
+		t.Fatalf("mget: got %v", got)
+	}
+
+	e = openEngine(t, dir, true)
+	assertGet(t, e, "a", "1", true)
+	assertGet(t, e, "b", "2", true)
+	assertGet(t, e, "c", "2", true)
+	assertGet(t, e, "expired", "new", true)
+	assertGet(t, e, "str", "v", true)
+	assertGet(t, e, "d", "", false)
+}
@@ -0,0 +1,192 @@
+package engine
+
+import (
+	"errors"
+	"github.com/awesome-cap/kv/ptl"
+	"strconv"
+)
+
+var (
+	HSet    = hsetHandler{}
+	HGet    = hgetHandler{}
+	HDel    = hdelHandler{}
+	HGetAll = hgetallHandler{}
+	HLen    = hlenHandler{}
+	HExists = hexistsHandler{}
+	HIncrBy = hincrbyHandler{}
+
+	HashValueNotIntegerError = errors.New("Hash value is not an integer. ")
+)
+
+// hashOf returns the fields of the hash stored at key, nil if the key does
+// not exist.
+func (e *Engine) hashOf(key string) (map[string]string, error) {
+	err := e.assertType(key, typeHash)
+	if err != nil {
+		return nil, err
+	}
+	if e.expired(key) {
+		return nil, nil
+	}
+	v, ok := e.hash.Get(key)
+	if !ok {
+		return nil, nil
+	}
+	return v.(map[string]string), nil
+}
+
+func cloneHash(fields map[string]string) map[string]string {
+	c := make(map[string]string, len(fields))
+	for field, value := range fields {
+		c[field] = value
+	}
+	return c
+}
+
+// hashOrCreate returns the hash stored at key, an empty one is created if
+// the key does not exist.
+func (e *Engine) hashOrCreate(key string) (map[string]string, error) {
+	fields, err := e.hashOf(key)
+	if err != nil || fields != nil {
+		return fields, err
+	}
+	e.Del(key)
+	fields = map[string]string{}
+	e.store(e.hash, key, fields)
+	return fields, nil
+}
+
+type hsetHandler struct{}
+
+func (h hsetHandler) handle(e *Engine, args []string) (ptl.Reply, error) {
+	if len(args)%2 != 0 {
+		return ptl.Reply{}, SyntaxError
+	}
+	fields, err := e.hashOrCreate(args[1])
+	if err != nil {
+		return ptl.Reply{}, err
+	}
+	added := 0
+	for i := 2; i < len(args); i += 2 {
+		if _, ok := fields[args[i]]; !ok {
+			added++
+		}
+		fields[args[i]] = args[i+1]
+	}
+	return ptl.Integer(int64(added)), nil
+}
+
+func (h hsetHandler) size() int    { return 4 }
+func (h hsetHandler) name() string { return "hset" }
+
+type hgetHandler struct{}
+
+func (h hgetHandler) handle(e *Engine, args []string) (ptl.Reply, error) {
+	fields, err := e.hashOf(args[1])
+	if err != nil {
+		return ptl.Reply{}, err
+	}
+	if v, ok := fields[args[2]]; ok {
+		return ptl.Bulk(v), nil
+	}
+	return ptl.Nil(), nil
+}
+
+func (h hgetHandler) size() int    { return 3 }
+func (h hgetHandler) name() string { return "hget" }
+
+type hdelHandler struct{}
+
+func (h hdelHandler) handle(e *Engine, args []string) (ptl.Reply, error) {
+	fields, err := e.hashOf(args[1])
+	if err != nil {
+		return ptl.Reply{}, err
+	}
+	deleted := 0
+	for _, field := range args[2:] {
+		if _, ok := fields[field]; ok {
+			delete(fields, field)
+			deleted++
+		}
+	}
+	if fields != nil && len(fields) == 0 {
+		e.Del(args[1])
+	}
+	return ptl.Integer(int64(deleted)), nil
+}
+
+func (h hdelHandler) size() int    { return 3 }
+func (h hdelHandler) name() string { return "hdel" }
+
+type hgetallHandler struct{}
+
+func (h hgetallHandler) handle(e *Engine, args []string) (ptl.Reply, error) {
+	fields, err := e.hashOf(args[1])
+	if err != nil {
+		return ptl.Reply{}, err
+	}
+	results := make([]string, 0, len(fields)*2)
+	for field, value := range fields {
+		results = append(results, field, value)
+	}
+	return ptl.Map(results), nil
+}
+
+func (h hgetallHandler) size() int    { return 2 }
+func (h hgetallHandler) name() string { return "hgetall" }
+
+type hlenHandler struct{}
+
+func (h hlenHandler) handle(e *Engine, args []string) (ptl.Reply, error) {
+	fields, err := e.hashOf(args[1])
+	if err != nil {
+		return ptl.Reply{}, err
+	}
+	return ptl.Integer(int64(len(fields))), nil
+}
+
+func (h hlenHandler) size() int    { return 2 }
+func (h hlenHandler) name() string { return "hlen" }
+
+type hexistsHandler struct{}
+
+func (h hexistsHandler) handle(e *Engine, args []string) (ptl.Reply, error) {
+	fields, err := e.hashOf(args[1])
+	if err != nil {
+		return ptl.Reply{}, err
+	}
+	_, ok := fields[args[2]]
+	return ptl.Bool(ok), nil
+}
+
+func (h hexistsHandler) size() int    { return 3 }
+func (h hexistsHandler) name() string { return "hexists" }
+
+type hincrbyHandler struct{}
+
+func (h hincrbyHandler) handle(e *Engine, args []string) (ptl.Reply, error) {
+	incr, err := strconv.ParseInt(args[3], 10, 64)
+	if err != nil {
+		return ptl.Reply{}, NotIntegerError
+	}
+	fields, err := e.hashOrCreate(args[1])
+	if err != nil {
+		return ptl.Reply{}, err
+	}
+	value := int64(0)
+	if v, ok := fields[args[2]]; ok {
+		value, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return ptl.Reply{}, HashValueNotIntegerError
+		}
+	}
+	value, err = incrBy(value, incr)
+	if err != nil {
+		return ptl.Reply{}, err
+	}
+	fields[args[2]] = strconv.FormatInt(value, 10)
+	return ptl.Integer(value), nil
+}
+
+func (h hincrbyHandler) size() int    { return 4 }
+func (h hincrbyHandler) name() string { return "hincrby" }
@@ -0,0 +1,110 @@
+package engine
+
+import (
+	"github.com/awesome-cap/kv/ptl"
+	"testing"
+)
+
+func TestHash(t *testing.T) {
+	dir := t.TempDir()
+	e := openEngine(t, dir, true)
+	if n := exec(t, e, "hset", "h", "a", "1", "b", "2")[0]; n != "2" {
+		t.Fatalf("hset: want 2, got %s", n)
+	}
+	if n := exec(t, e, "hset", "h", "a", "3", "c", "4")[0]; n != "1" {
+		t.Fatalf("hset existing field: want 1, got %s", n)
+	}
+	if _, err := e.Exec([]string{"hset", "h", "a", "1", "b"}); err != SyntaxError {
+		t.Fatalf("hset odd: want SyntaxError, got %v", err)
+	}
+
+	// HGETALL replies a map, every field followed by its value
+	reply, err := e.Exec([]string{"hgetall", "h"})
+	if err != nil || reply.Type != ptl.MapReply || len(reply.Array) != 6 {
+		t.Fatalf("hgetall: got %+v, %v", reply, err)
+	}
+	want := map[string]string{"a": "3", "b": "2", "c": "4"}
+	items := reply.Strings()
+	for i := 0; i < len(items); i += 2 {
+		if want[items[i]] != items[i+1] {
+			t.Fatalf("hgetall: want %v, got %v", want, items)
+		}
+		delete(want, items[i])
+	}
+	if reply, err := e.Exec([]string{"hgetall", "missing"}); err != nil || reply.Type != ptl.MapReply || len(reply.Array) != 0 {
+		t.Fatalf("hgetall missing: got %+v, %v", reply, err)
+	}
+
+	exec(t, e, "set", "str", "v")
+	for _, args := range [][]string{{"hset", "str", "f", "v"}, {"hdel", "str", "f"}, {"hgetall", "str"}} {
+		if _, err := e.Exec(args); err != WrongTypeError {
+			t.Fatalf("%v: want WrongTypeError, got %v", args, err)
+		}
+	}
+	assertGet(t, e, "str", "v", true)
+
+	// Deleting the last field deletes the key
+	if n := exec(t, e, "hdel", "h", "a", "missing")[0]; n != "1" {
+		t.Fatalf("hdel: want 1, got %s", n)
+	}
+	if n := exec(t, e, "hdel", "missing", "a")[0]; n != "0" {
+		t.Fatalf("hdel missing: want 0, got %s", n)
+	}
+	if n := exec(t, e, "hdel", "h", "b", "c")[0]; n != "2" {
+		t.Fatalf("hdel last: want 2, got %s", n)
+	}
+	if typ := exec(t, e, "type", "h")[0]; typ != typeNone {
+		t.Fatalf("type: want none, got %s", typ)
+	}
+	exec(t, e, "hset", "kept", "f", "v")
+
+	e = openEngine(t, dir, true)
+	if typ := exec(t, e, "type", "h")[0]; typ != typeNone {
+		t.Fatalf("type after restart: want none, got %s", typ)
+	}
+	if got := exec(t, e, "hgetall", "kept"); len(got) != 2 || got[0] != "f" || got[1] != "v" {
+		t.Fatalf("hgetall after restart: got %v", got)
+	}
+}
+
+func TestHIncrBy(t *testing.T) {
+	dir := t.TempDir()
+	e := openEngine(t, dir, true)
+	if v := exec(t, e, "hincrby", "h", "n", "5")[0]; v != "5" {
+		t.Fatalf("hincrby new: want 5, got %s", v)
+	}
+	if v := exec(t, e, "hincrby", "h", "n", "-7")[0]; v != "-2" {
+		t.Fatalf("hincrby: want -2, got %s", v)
+	}
+	exec(t, e, "hset", "h", "max", "9223372036854775807", "min", "-9223372036854775808", "s", "x")
+	for _, c := range []struct {
+		args []string
+		want error
+	}{
+		{[]string{"hincrby", "h", "max", "1"}, IncrOverflowError},
+		{[]string{"hincrby", "h", "min", "-1"}, IncrOverflowError},
+		{[]string{"hincrby", "h", "n", "-9223372036854775807"}, IncrOverflowError},
+		{[]string{"hincrby", "h", "s", "1"}, HashValueNotIntegerError},
+		{[]string{"hincrby", "h", "n", "1.5"}, NotIntegerError},
+		{[]string{"hincrby", "h", "n", "9223372036854775808"}, NotIntegerError},
+	} {
+		if _, err := e.Exec(c.args); err != c.want {
+			t.Fatalf("%v: want %v, got %v", c.args, c.want, err)
+		}
+	}
+	if v := exec(t, e, "hincrby", "h", "max", "-1")[0]; v != "9223372036854775806" {
+		t.Fatalf("hincrby max: want 9223372036854775806, got %s", v)
+	}
+	exec(t, e, "set", "str", "v")
+	if _, err := e.Exec([]string{"hincrby", "str", "f", "1"}); err != WrongTypeError {
+		t.Fatalf("hincrby string: want WrongTypeError, got %v", err)
+	}
+
+	// The failed increments change nothing after a replay either
+	e = openEngine(t, dir, true)
+	for field, want := range map[string]string{"n": "-2", "max": "9223372036854775806", "min": "-9223372036854775808", "s": "x"} {
+		if v := exec(t, e, "hget", "h", field); len(v) != 1 || v[0] != want {
+			t.Fatalf("hget %s: want %s, got %v", field, want, v)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package engine
+
+import (
+	"errors"
+	xlog "log"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	retryMinInterval = time.Second
+	retryMaxInterval = time.Minute
+)
+
+var (
+	ReadOnlyError = errors.New("READONLY Storage is not writable, writes are rejected until it recovers. ")
+)
+
+// Health is the state of the storage as its last writes found it.
+type Health struct {
+	// Writes are rejected until the daemon persists the engine again
+	ReadOnly bool
+	// Consecutive failures, and the last one
+	Failures  int
+	LastError error
+	LastAt    time.Time
+}
+
+// health records the failures of the storage, readOnly is read without the
+// lock on every write.
+type health struct {
+	sync.Mutex
+	Health
+
+	readOnly int32
+}
+
+// fail records err. Once the log or the disk is unwritable, degrade puts the
+// storage in read-only mode: a record left half written would corrupt the
+// log if writes went on after it.
+func (h *health) fail(err error, degrade bool) {
+	h.Lock()
+	defer h.Unlock()
+	if h.LastError == nil || h.LastError.Error() != err.Error() {
+		xlog.Println("Storage failure:", err)
+	}
+	h.Failures++
+	h.LastError = err
+	h.LastAt = time.Now()
+	if degrade && !h.ReadOnly {
+		xlog.Println("Storage is read-only until it recovers")
+		h.ReadOnly = true
+		atomic.StoreInt32(&h.readOnly, 1)
+	}
+}
+
+func (h *health) recover() {
+	h.Lock()
+	defer h.Unlock()
+	if h.ReadOnly {
+		xlog.Println("Storage recovered, writes are accepted again")
+	}
+	h.Failures = 0
+	h.ReadOnly = false
+	atomic.StoreInt32(&h.readOnly, 0)
+}
+
+func (h *health) degraded() bool {
+	return atomic.LoadInt32(&h.readOnly) == 1
+}
+
+func (h *health) get() Health {
+	h.Lock()
+	defer h.Unlock()
+	return h.Health
+}
+
+// backoff returns how long the daemon waits before it retries after failures
+// in a row, doubling from retryMinInterval up to limit.
+func backoff(failures int, limit time.Duration) time.Duration {
+	wait := retryMinInterval
+	for i := 1; i < failures && wait < limit; i++ {
+		wait *= 2
+	}
+	if wait > limit {
+		return limit
+	}
+	return wait
+}
+
+// unwritable reports whether err means the disk is full or refuses writes.
+func unwritable(err error) bool {
+	for _, errno := range []syscall.Errno{syscall.ENOSPC, syscall.EDQUOT, syscall.EROFS, syscall.EACCES, syscall.EPERM, syscall.EIO} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+// Health returns the state of the storage.
+func (s *Storage) Health() Health {
+	return s.health.get()
+}
+
+// Health returns the state of the engine's storage.
+func (e *Engine) Health() Health {
+	if e.storage == nil {
+		return Health{}
+	}
+	return e.storage.Health()
+}
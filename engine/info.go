@@ -0,0 +1,69 @@
+package engine
+
+import (
+	"fmt"
+	"github.com/awesome-cap/kv/ptl"
+	"strings"
+)
+
+var (
+	Info = infoHandler{}
+	Ping = pingHandler{}
+)
+
+type pingHandler struct{}
+
+// handle replies PONG, or the message if one is given, clients use it to
+// check their connections.
+func (h pingHandler) handle(e *Engine, args []string) (ptl.Reply, error) {
+	if len(args) > 1 {
+		return ptl.Bulk(args[1]), nil
+	}
+	return ptl.Status("PONG"), nil
+}
+
+func (h pingHandler) size() int    { return 1 }
+func (h pingHandler) name() string { return "ping" }
+
+type infoHandler struct{}
+
+// handle reports the state of the engine and its storage as field:value
+// lines, like the INFO of Redis.
+func (h infoHandler) handle(e *Engine, args []string) (ptl.Reply, error) {
+	s := e.storage
+	health, cache := s.Health(), s.CacheStats()
+	status, lastError := "ok", ""
+	if health.ReadOnly {
+		status = "read_only"
+	}
+	if health.LastError != nil {
+		lastError = health.LastError.Error()
+	}
+	lines := []string{
+		fmt.Sprintf("lsn:%d", e.lsn),
+		fmt.Sprintf("log_enabled:%d", flag(s.conf.Log.Enable)),
+		fmt.Sprintf("log_fsync:%s", s.policy),
+		fmt.Sprintf("log_synced_lsn:%d", s.synced()),
+		fmt.Sprintf("db_enabled:%d", flag(s.conf.DB.Enable)),
+		fmt.Sprintf("db_archives:%d", s.archived().Len()),
+		fmt.Sprintf("storage_status:%s", status),
+		fmt.Sprintf("storage_failures:%d", health.Failures),
+		fmt.Sprintf("storage_last_error:%s", lastError),
+		fmt.Sprintf("cache_entries:%d", cache.Entries),
+		fmt.Sprintf("cache_size:%d", cache.Size),
+		fmt.Sprintf("cache_hits:%d", cache.Hits),
+		fmt.Sprintf("cache_misses:%d", cache.Misses),
+		fmt.Sprintf("cache_evictions:%d", cache.Evictions),
+	}
+	return ptl.Bulk(strings.Join(lines, "\r\n") + "\r\n"), nil
+}
+
+func (h infoHandler) size() int    { return 1 }
+func (h infoHandler) name() string { return "info" }
+
+func flag(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
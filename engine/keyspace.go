@@ -0,0 +1,337 @@
+package engine
+
+import (
+	"errors"
+	"github.com/awesome-cap/hashmap"
+	"github.com/awesome-cap/kv/ptl"
+	"hash/fnv"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+var (
+	Exists    = existsHandler{}
+	Type      = typeHandler{}
+	Rename    = renameHandler{}
+	RenameNX  = renameHandler{nx: true}
+	Keys      = keysHandler{}
+	DBSize    = dbsizeHandler{}
+	RandomKey = randomkeyHandler{}
+	Scan      = scanHandler{}
+
+	NoSuchKeyError     = errors.New("No such key. ")
+	InvalidCursorError = errors.New("Invalid cursor. ")
+)
+
+// inMemory reports whether any key space holds key, expired or not. Such
+// a key shadows the values archived dbs may still hold for it.
+func (e *Engine) inMemory(key string) bool {
+	for _, space := range e.spaces() {
+		if _, ok := space.Get(key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// keyType is like typeOf, but also finds the string keys which only live
+// in archived dbs.
+func (e *Engine) keyType(key string) string {
+	if t := e.typeOf(key); t != typeNone {
+		return t
+	}
+	if _, ok := e.Get(key); ok {
+		return typeString
+	}
+	return typeNone
+}
+
+// indexKey adds key to the index, unless it's there already.
+func (e *Engine) indexKey(key string) {
+	score := float64(keyHash(key))
+	if e.index.rank(score, key) == 0 {
+		e.index.insert(score, key)
+	}
+}
+
+// reindex builds the index from the loaded key spaces and the string keys
+// which only live in archived dbs. Later on it's kept up by store and Del.
+func (e *Engine) reindex() {
+	e.index = newSkiplist()
+	for _, space := range e.spaces() {
+		space.Foreach(func(entry *hashmap.Entry) {
+			e.indexKey(entry.Key().(string))
+		})
+	}
+	if e.storage == nil {
+		return
+	}
+	e.storage.keys(func(key string) {
+		if !e.inMemory(key) && !e.tombstoned(key) {
+			e.indexKey(key)
+		}
+	})
+}
+
+// foreachKey calls fn once for every live key, including the string keys
+// which only live in archived dbs.
+func (e *Engine) foreachKey(fn func(key string)) {
+	for node := e.index.head.next(); node != nil; node = node.next() {
+		if e.keyType(node.member) != typeNone {
+			fn(node.member)
+		}
+	}
+}
+
+// match reports whether s matches the glob-style pattern, which supports
+// *, ?, [...] classes with ranges and ^ negation, and \ escapes.
+func match(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if match(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+			s = s[1:]
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			pattern = pattern[1:]
+			not := len(pattern) > 0 && pattern[0] == '^'
+			if not {
+				pattern = pattern[1:]
+			}
+			matched := false
+			for len(pattern) > 0 && pattern[0] != ']' {
+				if pattern[0] == '\\' && len(pattern) >= 2 {
+					pattern = pattern[1:]
+					matched = matched || pattern[0] == s[0]
+				} else if len(pattern) >= 3 && pattern[1] == '-' {
+					start, end := pattern[0], pattern[2]
+					if start > end {
+						start, end = end, start
+					}
+					matched = matched || (s[0] >= start && s[0] <= end)
+					pattern = pattern[2:]
+				} else {
+					matched = matched || pattern[0] == s[0]
+				}
+				pattern = pattern[1:]
+			}
+			if matched == not {
+				return false
+			}
+			s = s[1:]
+			// An unterminated class ends the pattern
+			if len(pattern) == 0 {
+				return len(s) == 0
+			}
+		case '\\':
+			if len(pattern) >= 2 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || pattern[0] != s[0] {
+				return false
+			}
+			s = s[1:]
+		}
+		pattern = pattern[1:]
+	}
+	return len(s) == 0
+}
+
+type existsHandler struct{}
+
+func (h existsHandler) handle(e *Engine, args []string) (ptl.Reply, error) {
+	count := 0
+	for _, key := range args[1:] {
+		if e.keyType(key) != typeNone {
+			count++
+		}
+	}
+	return ptl.Integer(int64(count)), nil
+}
+
+func (h existsHandler) size() int    { return 2 }
+func (h existsHandler) name() string { return "exists" }
+
+type typeHandler struct{}
+
+func (h typeHandler) handle(e *Engine, args []string) (ptl.Reply, error) {
+	return ptl.Status(e.keyType(args[1])), nil
+}
+
+func (h typeHandler) size() int    { return 2 }
+func (h typeHandler) name() string { return "type" }
+
+type renameHandler struct {
+	nx bool
+}
+
+func (h renameHandler) handle(e *Engine, args []string) (ptl.Reply, error) {
+	key, newKey := args[1], args[2]
+	t := e.keyType(key)
+	if t == typeNone {
+		return ptl.Reply{}, NoSuchKeyError
+	}
+	if key == newKey {
+		return h.renamed(), nil
+	}
+	if h.nx && e.keyType(newKey) != typeNone {
+		return ptl.Integer(0), nil
+	}
+	var value interface{}
+	if e.inMemory(key) {
+		value, _ = e.spaces()[t].Get(key)
+	} else {
+		value, _ = e.Get(key)
+	}
+	at, expires := e.expire.Get(key)
+	e.Del(key)
+	e.Del(newKey)
+	e.store(e.spaces()[t], newKey, value)
+	if expires {
+		e.expire.Set(newKey, at)
+	}
+	if t == typeList {
+		e.signal(newKey)
+	}
+	return h.renamed(), nil
+}
+
+// renamed replies OK to RENAME and 1 to RENAMENX.
+func (h renameHandler) renamed() ptl.Reply {
+	if h.nx {
+		return ptl.Integer(1)
+	}
+	return ptl.OK()
+}
+
+func (h renameHandler) size() int { return 3 }
+func (h renameHandler) name() string {
+	if h.nx {
+		return "renamenx"
+	}
+	return "rename"
+}
+
+type keysHandler struct{}
+
+func (h keysHandler) handle(e *Engine, args []string) (ptl.Reply, error) {
+	keys := make([]string, 0)
+	e.foreachKey(func(key string) {
+		if match(args[1], key) {
+			keys = append(keys, key)
+		}
+	})
+	return ptl.Bulks(keys), nil
+}
+
+func (h keysHandler) size() int    { return 2 }
+func (h keysHandler) name() string { return "keys" }
+
+type dbsizeHandler struct{}
+
+// Like with Redis, the keys which expired but weren't removed yet are
+// counted as well.
+func (h dbsizeHandler) handle(e *Engine, args []string) (ptl.Reply, error) {
+	return ptl.Integer(int64(e.index.length)), nil
+}
+
+func (h dbsizeHandler) size() int    { return 1 }
+func (h dbsizeHandler) name() string { return "dbsize" }
+
+type randomkeyHandler struct{}
+
+// handle picks a random key of the index, then walks on from there up to the
+// first live one.
+func (h randomkeyHandler) handle(e *Engine, args []string) (ptl.Reply, error) {
+	if e.index.length == 0 {
+		return ptl.Nil(), nil
+	}
+	node := e.index.byRank(rand.Intn(e.index.length) + 1)
+	for i := 0; i < e.index.length; i++ {
+		if e.keyType(node.member) != typeNone {
+			return ptl.Bulk(node.member), nil
+		}
+		if node = node.next(); node == nil {
+			node = e.index.head.next()
+		}
+	}
+	return ptl.Nil(), nil
+}
+
+func (h randomkeyHandler) size() int    { return 1 }
+func (h randomkeyHandler) name() string { return "randomkey" }
+
+func keyHash(key string) uint64 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return uint64(h.Sum32())
+}
+
+// scanHandler walks the key space in the order of a stable 32-bit hash of
+// the keys, the cursor is the next hash to resume from and 0 once the walk
+// is over. Since a key's hash never changes, every key which exists for
+// the whole walk is returned exactly once, no matter how the key spaces
+// are resized in between. The index keeps the keys in that order, so each
+// call only walks COUNT of them.
+type scanHandler struct{}
+
+func (h scanHandler) handle(e *Engine, args []string) (ptl.Reply, error) {
+	cursor, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		return ptl.Reply{}, InvalidCursorError
+	}
+	pattern, count := "*", 10
+	for i := 2; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return ptl.Reply{}, SyntaxError
+		}
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			count, err = strconv.Atoi(args[i+1])
+			if err != nil || count < 1 {
+				return ptl.Reply{}, SyntaxError
+			}
+		default:
+			return ptl.Reply{}, SyntaxError
+		}
+	}
+	keys, next := make([]string, 0), "0"
+	walked := 0
+	for node := e.index.first(float64(cursor), false); node != nil; node = node.next() {
+		// Keys sharing the hash of the last one returned go in the same batch
+		if walked >= count && node.score != node.prev().score {
+			next = strconv.FormatUint(uint64(node.score), 10)
+			break
+		}
+		walked++
+		if match(pattern, node.member) && e.keyType(node.member) != typeNone {
+			keys = append(keys, node.member)
+		}
+	}
+	return ptl.Array(ptl.Bulk(next), ptl.Bulks(keys)), nil
+}
+
+func (h scanHandler) size() int    { return 2 }
+func (h scanHandler) name() string { return "scan" }
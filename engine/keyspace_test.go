@@ -0,0 +1,198 @@
+package engine
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// scanAll walks the whole key space with SCAN and returns the keys by
+// number of times they were returned.
+func scanAll(t *testing.T, e *Engine, args ...string) map[string]int {
+	seen := map[string]int{}
+	cursor := "0"
+	for calls := 0; ; calls++ {
+		if calls > 1000 {
+			t.Fatal("scan: cursor never returned to 0")
+		}
+		reply, err := e.Exec(append([]string{"scan", cursor}, args...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cursor = reply.Array[0].Str
+		for _, key := range reply.Array[1].Strings() {
+			seen[key]++
+		}
+		if cursor == "0" {
+			return seen
+		}
+	}
+}
+
+func TestScan(t *testing.T) {
+	dir := t.TempDir()
+	// The strings only live in the older archive, the newest one is loaded
+	// into memory
+	a := newEngine()
+	a.Registry(Set)
+	for i := 0; i < 50; i++ {
+		a.exec([]string{"set", "s" + strconv.Itoa(i), "v"})
+	}
+	b := newEngine()
+	b.Registry(HSet, RPush)
+	b.exec([]string{"hset", "h", "f", "v"})
+	b.exec([]string{"rpush", "l", "a"})
+	for i, archived := range []*Engine{a, b} {
+		path := filepath.Join(dir, fmt.Sprintf("s_%d.db", i+1))
+		if err := ioutil.WriteFile(path, marshalSorted(t, archived), 0766); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e := openEngine(t, dir, false)
+	if e.inMemory("s0") || !e.inMemory("h") {
+		t.Fatal("load: want only the newest archive in memory")
+	}
+	for i := 0; i < 25; i++ {
+		exec(t, e, "del", "s"+strconv.Itoa(i))
+	}
+	exec(t, e, "sadd", "set", "m")
+	if n := exec(t, e, "dbsize")[0]; n != "28" {
+		t.Fatalf("dbsize: want 28, got %s", n)
+	}
+	seen := scanAll(t, e, "count", "3")
+	if len(seen) != 28 {
+		t.Fatalf("scan: want 28 keys, got %d", len(seen))
+	}
+	for key, n := range seen {
+		if n != 1 {
+			t.Fatalf("scan: %s returned %d times", key, n)
+		}
+	}
+
+	// Keys existing for the whole walk are returned despite the writes
+	cursor, seen := "0", map[string]int{}
+	for i := 0; ; i++ {
+		reply, err := e.Exec([]string{"scan", cursor})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range reply.Array[1].Strings() {
+			seen[key]++
+		}
+		exec(t, e, "set", "new"+strconv.Itoa(i), "v")
+		exec(t, e, "del", "new"+strconv.Itoa(i-1))
+		if cursor = reply.Array[0].Str; cursor == "0" {
+			break
+		}
+	}
+	for i := 25; i < 50; i++ {
+		if seen["s"+strconv.Itoa(i)] != 1 {
+			t.Fatalf("scan: s%d returned %d times", i, seen["s"+strconv.Itoa(i)])
+		}
+	}
+
+	if _, err := e.Exec([]string{"scan", "-1"}); err != InvalidCursorError {
+		t.Fatalf("scan -1: want InvalidCursorError, got %v", err)
+	}
+	for _, args := range [][]string{{"count", "0"}, {"count"}, {"type", "string"}} {
+		if _, err := e.Exec(append([]string{"scan", "0"}, args...)); err != SyntaxError {
+			t.Fatalf("scan %v: want SyntaxError, got %v", args, err)
+		}
+	}
+	// A cursor beyond every hash ends the walk
+	reply, err := e.Exec([]string{"scan", "18446744073709551615"})
+	if err != nil || reply.Array[0].Str != "0" || len(reply.Array[1].Array) != 0 {
+		t.Fatalf("scan max: got %v, %v", reply, err)
+	}
+}
+
+func TestScanMatch(t *testing.T) {
+	e := openEngine(t, t.TempDir(), false)
+	for _, key := range []string{"user:1", "user:2", "user:10", "u*", "u?", "item:1", ""} {
+		exec(t, e, "set", key, "v")
+	}
+	for _, c := range []struct {
+		pattern string
+		want    []string
+	}{
+		{"*", []string{"", "item:1", "u*", "u?", "user:1", "user:10", "user:2"}},
+		{"user:?", []string{"user:1", "user:2"}},
+		{"user:*0", []string{"user:10"}},
+		{"user:[1-2]", []string{"user:1", "user:2"}},
+		{"user:[^1]", []string{"user:2"}},
+		{"u\\*", []string{"u*"}},
+		{"u[?]", []string{"u?"}},
+		{"user:[1", []string{"user:1"}},
+		{"", []string{""}},
+		{"nothing*", []string{}},
+	} {
+		seen := scanAll(t, e, "match", c.pattern, "count", "2")
+		keys := make([]string, 0, len(seen))
+		for key := range seen {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		if len(keys) != len(c.want) {
+			t.Fatalf("scan match %q: want %v, got %v", c.pattern, c.want, keys)
+		}
+		for i := range keys {
+			if keys[i] != c.want[i] {
+				t.Fatalf("scan match %q: want %v, got %v", c.pattern, c.want, keys)
+			}
+		}
+		if n := len(exec(t, e, "keys", c.pattern)); n != len(c.want) {
+			t.Fatalf("keys %q: want %d keys, got %d", c.pattern, len(c.want), n)
+		}
+	}
+}
+
+func TestRandomKey(t *testing.T) {
+	e := openEngine(t, t.TempDir(), false)
+	if v := exec(t, e, "randomkey"); len(v) != 0 {
+		t.Fatalf("randomkey: want nil, got %v", v)
+	}
+	exec(t, e, "set", "a", "v")
+	exec(t, e, "set", "b", "v")
+	exec(t, e, "pexpire", "b", "1")
+	exec(t, e, "hset", "c", "f", "v")
+	exec(t, e, "del", "c")
+	time.Sleep(5 * time.Millisecond)
+	// The expired key is still indexed until swept, but never picked
+	for i := 0; i < 20; i++ {
+		if v := exec(t, e, "randomkey"); len(v) != 1 || v[0] != "a" {
+			t.Fatalf("randomkey: got %v", v)
+		}
+	}
+}
+
+// Key space reads run under the read lock, alongside concurrent writes.
+func TestKeySpaceConcurrency(t *testing.T) {
+	e := openEngine(t, t.TempDir(), false)
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			key := "k" + strconv.Itoa(i%20)
+			_, _ = e.Exec([]string{"set", key, "v"})
+			_, _ = e.Exec([]string{"del", key})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			for _, cmd := range [][]string{{"keys", "*"}, {"scan", "0"}, {"dbsize"}, {"randomkey"}} {
+				if _, err := e.Exec(cmd); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}
+	}()
+	wg.Wait()
+}
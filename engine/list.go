@@ -0,0 +1,313 @@
+package engine
+
+import (
+	"container/list"
+	"errors"
+	"github.com/awesome-cap/kv/ptl"
+	"math"
+	"strconv"
+	"time"
+)
+
+var (
+	LPush  = pushHandler{left: true}
+	RPush  = pushHandler{}
+	LPop   = popHandler{left: true}
+	RPop   = popHandler{}
+	LRange = lrangeHandler{}
+	LLen   = llenHandler{}
+	LIndex = lindexHandler{}
+	LTrim  = ltrimHandler{}
+	BLPop  = bpopHandler{left: true}
+	BRPop  = bpopHandler{}
+
+	NegativeTimeoutError = errors.New("Timeout is negative. ")
+	InvalidTimeoutError  = errors.New("Timeout is not a float or out of range. ")
+)
+
+// listOf returns the list stored at key, nil if the key does not exist.
+func (e *Engine) listOf(key string) (*list.List, error) {
+	err := e.assertType(key, typeList)
+	if err != nil {
+		return nil, err
+	}
+	if e.expired(key) {
+		return nil, nil
+	}
+	v, ok := e.list.Get(key)
+	if !ok {
+		return nil, nil
+	}
+	return v.(*list.List), nil
+}
+
+func cloneList(items *list.List) *list.List {
+	c := list.New()
+	c.PushBackList(items)
+	return c
+}
+
+// listOrCreate returns the list stored at key, an empty one is created if
+// the key does not exist.
+func (e *Engine) listOrCreate(key string) (*list.List, error) {
+	items, err := e.listOf(key)
+	if err != nil || items != nil {
+		return items, err
+	}
+	e.Del(key)
+	items = list.New()
+	e.store(e.list, key, items)
+	return items, nil
+}
+
+// pop removes the first or last item of the list stored at key, the key
+// is deleted along with its last item.
+func (e *Engine) pop(key string, left bool) (string, bool, error) {
+	items, err := e.listOf(key)
+	if err != nil || items == nil {
+		return "", false, err
+	}
+	item := items.Back()
+	if left {
+		item = items.Front()
+	}
+	items.Remove(item)
+	if items.Len() == 0 {
+		e.Del(key)
+	}
+	return item.Value.(string), true, nil
+}
+
+// rangeOf converts inclusive and possibly negative start and stop indexes
+// into a range within length, ok is false if the range is empty.
+func rangeOf(start, stop, length int) (int, int, bool) {
+	if start < 0 {
+		start += length
+	}
+	if stop < 0 {
+		stop += length
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= length {
+		stop = length - 1
+	}
+	return start, stop, start <= stop && start < length
+}
+
+func parseRange(args []string) (int, int, error) {
+	start, err := strconv.Atoi(args[0])
+	if err != nil {
+		return 0, 0, NotIntegerError
+	}
+	stop, err := strconv.Atoi(args[1])
+	if err != nil {
+		return 0, 0, NotIntegerError
+	}
+	return start, stop, nil
+}
+
+type pushHandler struct {
+	left bool
+}
+
+func (h pushHandler) handle(e *Engine, args []string) (ptl.Reply, error) {
+	items, err := e.listOrCreate(args[1])
+	if err != nil {
+		return ptl.Reply{}, err
+	}
+	for _, value := range args[2:] {
+		if h.left {
+			items.PushFront(value)
+		} else {
+			items.PushBack(value)
+		}
+	}
+	e.signal(args[1])
+	return ptl.Integer(int64(items.Len())), nil
+}
+
+func (h pushHandler) size() int { return 3 }
+func (h pushHandler) name() string {
+	if h.left {
+		return "lpush"
+	}
+	return "rpush"
+}
+
+type popHandler struct {
+	left bool
+}
+
+func (h popHandler) handle(e *Engine, args []string) (ptl.Reply, error) {
+	value, ok, err := e.pop(args[1], h.left)
+	if err != nil || !ok {
+		return ptl.Nil(), err
+	}
+	return ptl.Bulk(value), nil
+}
+
+func (h popHandler) size() int { return 2 }
+func (h popHandler) name() string {
+	if h.left {
+		return "lpop"
+	}
+	return "rpop"
+}
+
+type lrangeHandler struct{}
+
+func (h lrangeHandler) handle(e *Engine, args []string) (ptl.Reply, error) {
+	start, stop, err := parseRange(args[2:])
+	if err != nil {
+		return ptl.Reply{}, err
+	}
+	items, err := e.listOf(args[1])
+	if err != nil || items == nil {
+		return ptl.Array(), err
+	}
+	start, stop, ok := rangeOf(start, stop, items.Len())
+	if !ok {
+		return ptl.Array(), nil
+	}
+	results := make([]string, 0, stop-start+1)
+	i := 0
+	for item := items.Front(); item != nil && i <= stop; item = item.Next() {
+		if i >= start {
+			results = append(results, item.Value.(string))
+		}
+		i++
+	}
+	return ptl.Bulks(results), nil
+}
+
+func (h lrangeHandler) size() int    { return 4 }
+func (h lrangeHandler) name() string { return "lrange" }
+
+type llenHandler struct{}
+
+func (h llenHandler) handle(e *Engine, args []string) (ptl.Reply, error) {
+	items, err := e.listOf(args[1])
+	if err != nil || items == nil {
+		return ptl.Integer(0), err
+	}
+	return ptl.Integer(int64(items.Len())), nil
+}
+
+func (h llenHandler) size() int    { return 2 }
+func (h llenHandler) name() string { return "llen" }
+
+type lindexHandler struct{}
+
+func (h lindexHandler) handle(e *Engine, args []string) (ptl.Reply, error) {
+	index, err := strconv.Atoi(args[2])
+	if err != nil {
+		return ptl.Reply{}, NotIntegerError
+	}
+	items, err := e.listOf(args[1])
+	if err != nil || items == nil {
+		return ptl.Nil(), err
+	}
+	if index < 0 {
+		index += items.Len()
+	}
+	if index < 0 || index >= items.Len() {
+		return ptl.Nil(), nil
+	}
+	item := items.Front()
+	for i := 0; i < index; i++ {
+		item = item.Next()
+	}
+	return ptl.Bulk(item.Value.(string)), nil
+}
+
+func (h lindexHandler) size() int    { return 3 }
+func (h lindexHandler) name() string { return "lindex" }
+
+type ltrimHandler struct{}
+
+func (h ltrimHandler) handle(e *Engine, args []string) (ptl.Reply, error) {
+	start, stop, err := parseRange(args[2:])
+	if err != nil {
+		return ptl.Reply{}, err
+	}
+	items, err := e.listOf(args[1])
+	if err != nil || items == nil {
+		return ptl.OK(), err
+	}
+	start, stop, ok := rangeOf(start, stop, items.Len())
+	if !ok {
+		e.Del(args[1])
+		return ptl.OK(), nil
+	}
+	for i := items.Len() - 1; i > stop; i-- {
+		items.Remove(items.Back())
+	}
+	for i := 0; i < start; i++ {
+		items.Remove(items.Front())
+	}
+	return ptl.OK(), nil
+}
+
+func (h ltrimHandler) size() int    { return 4 }
+func (h ltrimHandler) name() string { return "ltrim" }
+
+type bpopHandler struct {
+	left bool
+}
+
+func (h bpopHandler) keys(args []string) []string {
+	return args[1 : len(args)-1]
+}
+
+func (h bpopHandler) timeout(args []string) (time.Duration, error) {
+	seconds, err := strconv.ParseFloat(args[len(args)-1], 64)
+	if err != nil || math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+		return 0, InvalidTimeoutError
+	}
+	if seconds < 0 {
+		return 0, NegativeTimeoutError
+	}
+	// Longer timeouts overflow the duration
+	if seconds >= math.MaxInt64/float64(time.Second) {
+		return 0, InvalidTimeoutError
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// rewrite logs the pop against the first non-empty key only, replaying it
+// must not depend on which of the keys were empty at that time.
+func (h bpopHandler) rewrite(e *Engine, args []string) ([]string, error) {
+	for _, key := range h.keys(args) {
+		items, err := e.listOf(key)
+		if err != nil {
+			return nil, err
+		}
+		if items != nil {
+			return []string{args[0], key, "0"}, nil
+		}
+	}
+	return nil, blockedError
+}
+
+func (h bpopHandler) handle(e *Engine, args []string) (ptl.Reply, error) {
+	for _, key := range h.keys(args) {
+		value, ok, err := e.pop(key, h.left)
+		if err != nil {
+			return ptl.Reply{}, err
+		}
+		if ok {
+			return ptl.Bulks([]string{key, value}), nil
+		}
+	}
+	return ptl.NilArray(), nil
+}
+
+func (h bpopHandler) size() int { return 3 }
+func (h bpopHandler) name() string {
+	if h.left {
+		return "blpop"
+	}
+	return "brpop"
+}
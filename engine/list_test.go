@@ -0,0 +1,116 @@
+package engine
+
+import (
+	"context"
+	"github.com/awesome-cap/kv/ptl"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLTrim(t *testing.T) {
+	dir := t.TempDir()
+	e := openEngine(t, dir, true)
+	for _, c := range []struct {
+		start, stop string
+		want        string
+	}{
+		{"1", "-2", "b c d"},
+		{"-100", "100", "a b c d e"},
+		{"0", "0", "a"},
+		{"-2", "-1", "d e"},
+		{"3", "1", ""},
+		{"5", "10", ""},
+	} {
+		exec(t, e, "del", "l")
+		exec(t, e, "rpush", "l", "a", "b", "c", "d", "e")
+		exec(t, e, "ltrim", "l", c.start, c.stop)
+		if got := strings.Join(exec(t, e, "lrange", "l", "0", "-1"), " "); got != c.want {
+			t.Fatalf("ltrim %s %s: want %q, got %q", c.start, c.stop, c.want, got)
+		}
+	}
+	// Trimming away every item deletes the key
+	if typ := exec(t, e, "type", "l")[0]; typ != typeNone {
+		t.Fatalf("type: want none, got %s", typ)
+	}
+	if _, err := e.Exec([]string{"ltrim", "l", "x", "1"}); err != NotIntegerError {
+		t.Fatalf("ltrim x: want NotIntegerError, got %v", err)
+	}
+	exec(t, e, "rpush", "kept", "a", "b", "c")
+	exec(t, e, "ltrim", "kept", "1", "1")
+
+	e = openEngine(t, dir, true)
+	if got := exec(t, e, "lrange", "kept", "0", "-1"); len(got) != 1 || got[0] != "b" {
+		t.Fatalf("lrange after restart: got %v", got)
+	}
+}
+
+func TestBRPop(t *testing.T) {
+	dir := t.TempDir()
+	e := openEngine(t, dir, true)
+	exec(t, e, "rpush", "second", "a", "b")
+	// The first non-empty key is popped
+	if got := strings.Join(exec(t, e, "brpop", "first", "second", "0"), " "); got != "second b" {
+		t.Fatalf("brpop: want \"second b\", got %q", got)
+	}
+
+	// A push wakes up the blocked pop
+	popped := make(chan []string, 1)
+	go func() {
+		reply, err := e.Exec([]string{"brpop", "first", "empty", "5"})
+		if err != nil {
+			t.Error(err)
+		}
+		popped <- reply.Strings()
+	}()
+	time.Sleep(20 * time.Millisecond)
+	exec(t, e, "lpush", "empty", "x")
+	select {
+	case got := <-popped:
+		if strings.Join(got, " ") != "empty x" {
+			t.Fatalf("brpop woken: want \"empty x\", got %v", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("brpop: not woken by the push")
+	}
+
+	// On timeout the reply is a nil array
+	start := time.Now()
+	reply, err := e.Exec([]string{"brpop", "first", "0.05"})
+	if err != nil || reply.Type != ptl.NilArrayReply {
+		t.Fatalf("brpop timeout: got %+v, %v", reply, err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("brpop timeout: returned after %v", elapsed)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := e.ExecContext(ctx, []string{"brpop", "first", "0"}); err != context.DeadlineExceeded {
+		t.Fatalf("brpop cancelled: want DeadlineExceeded, got %v", err)
+	}
+	for timeout, want := range map[string]error{
+		"-1":    NegativeTimeoutError,
+		"x":     InvalidTimeoutError,
+		"NaN":   InvalidTimeoutError,
+		"inf":   InvalidTimeoutError,
+		"-Inf":  InvalidTimeoutError,
+		"1e300": InvalidTimeoutError,
+	} {
+		if _, err := e.Exec([]string{"brpop", "first", timeout}); err != want {
+			t.Fatalf("brpop %s: want %v, got %v", timeout, want, err)
+		}
+	}
+	exec(t, e, "set", "str", "v")
+	if _, err := e.Exec([]string{"brpop", "str", "0"}); err != WrongTypeError {
+		t.Fatalf("brpop string: want WrongTypeError, got %v", err)
+	}
+
+	// Replay pops from the same keys
+	e = openEngine(t, dir, true)
+	if got := exec(t, e, "lrange", "second", "0", "-1"); len(got) != 1 || got[0] != "a" {
+		t.Fatalf("lrange second after restart: got %v", got)
+	}
+	if typ := exec(t, e, "type", "empty")[0]; typ != typeNone {
+		t.Fatalf("type empty after restart: want none, got %s", typ)
+	}
+}
@@ -0,0 +1,274 @@
+package engine
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/awesome-cap/kv/config"
+	"github.com/awesome-cap/kv/ptl"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+type logs []*log
+
+func (l logs) Len() int {
+	return len(l)
+}
+
+func (l logs) Less(i, j int) bool {
+	return l[i].first < l[j].first
+}
+
+func (l logs) Swap(i, j int) {
+	l[i], l[j] = l[j], l[i]
+}
+
+func (l *log) path() string {
+	return l.dir + string(os.PathSeparator) + l.name
+}
+
+// replay applies the records of the segment which the engine has not seen
+// yet. A record torn by a crash at the end of the segment is cut off, a
+// damaged record in the middle fails the replay.
+func (l *log) replay(e *Engine) error {
+	file, err := os.OpenFile(l.path(), os.O_RDWR, os.FileMode(0766))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	versioned, err := readHeader(reader, logMagic)
+	if err != nil {
+		return fmt.Errorf("%s: %w", l.path(), err)
+	}
+	if !versioned {
+		l.replayUnversioned(e, reader)
+		return nil
+	}
+	counter := &countingReader{Reader: reader}
+	offset := int64(headerSize)
+	for {
+		lsn, args, err := ptl.UnMarshalRecord(counter)
+		if err == io.EOF {
+			return nil
+		}
+		if err == io.ErrUnexpectedEOF || err == ptl.ChecksumMismatchError && zeroed(reader) {
+			return file.Truncate(offset)
+		}
+		if err == ptl.ChecksumMismatchError {
+			return fmt.Errorf("%s: offset %d: %w", l.path(), offset, CorruptedLogError)
+		}
+		if err != nil {
+			return err
+		}
+		offset = headerSize + counter.n
+		if lsn > e.lsn {
+			e.lsn = lsn
+			e.exec(args)
+		}
+	}
+}
+
+// replayUnversioned reads a segment written before records carried
+// checksums, replay stops at the first unreadable record.
+func (l *log) replayUnversioned(e *Engine, reader io.Reader) {
+	for {
+		lsn, args, err := ptl.UnMarshalWrappedLSN(reader)
+		if err != nil {
+			return
+		}
+		if lsn > e.lsn {
+			e.lsn = lsn
+			e.exec(args)
+		}
+	}
+}
+
+// segment parses the name of a log segment. The unsegmented redo.log of older
+// versions is renamed into the first segment.
+func (s *Storage) segment(name string) (*log, error) {
+	l := &log{dir: s.conf.Dir, name: name}
+	if name == fmt.Sprintf(logFileNameFormatter, "redo") {
+		migrated := &log{dir: s.conf.Dir, name: fmt.Sprintf(logSegmentFormatter, 0)}
+		err := os.Rename(l.path(), migrated.path())
+		if err != nil {
+			return nil, err
+		}
+		return migrated, nil
+	}
+	_, err := fmt.Sscanf(name, logSegmentFormatter, &l.first)
+	if err != nil || fmt.Sprintf(logSegmentFormatter, l.first) != name {
+		return nil, InvalidLogFileNameError
+	}
+	return l, nil
+}
+
+// rotate closes the current segment and starts a new one after the last
+// assigned lsn. Writes must be excluded while it runs.
+func (s *Storage) rotate() error {
+	if !s.conf.Log.Enable {
+		return nil
+	}
+	first := atomic.LoadUint64(&s.lsn) + 1
+	if s.log != nil && s.log.first == first {
+		return nil
+	}
+	l := &log{first: first, dir: s.conf.Dir, name: fmt.Sprintf(logSegmentFormatter, first)}
+	file, err := os.OpenFile(l.path(), os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_APPEND, os.FileMode(0766))
+	if err != nil {
+		return err
+	}
+	err = writeHeader(file, logMagic)
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	l.file = file
+	// Records of the closed segment are synced whatever the policy
+	g := s.fsync
+	g.Lock()
+	defer g.Unlock()
+	for g.syncing {
+		g.cond.Wait()
+	}
+	if s.log != nil {
+		err = s.log.file.Sync()
+		if err != nil {
+			_ = file.Close()
+			return err
+		}
+		g.synced = g.written
+		_ = s.log.file.Close()
+	}
+	// A segment left with no readable record is replaced
+	if n := s.logs.Len(); n > 0 && s.logs[n-1].first == first {
+		s.logs = s.logs[:n-1]
+	}
+	s.logs = append(s.logs, l)
+	s.log = l
+	return syncDir(s.conf.Dir)
+}
+
+// truncate deletes the segments whose records are all covered by the
+// snapshot taken at checkpoint.
+func (s *Storage) truncate(checkpoint uint64) error {
+	if !s.conf.Log.Enable {
+		return nil
+	}
+	var err error
+	kept := logs{}
+	for i, l := range s.logs {
+		if i+1 < s.logs.Len() && s.logs[i+1].first <= checkpoint+1 {
+			if e := os.Remove(l.path()); e == nil || os.IsNotExist(e) {
+				continue
+			} else if err == nil {
+				err = e
+			}
+		}
+		kept = append(kept, l)
+	}
+	s.logs = kept
+	return err
+}
+
+// fsyncPolicy returns the configured fsync policy of the log, or the one
+// DB.FlushMethod selects.
+func fsyncPolicy(conf config.Storage) (string, error) {
+	switch conf.Log.Fsync {
+	case config.FsyncAlways, config.FsyncEverySec, config.FsyncNo:
+		return conf.Log.Fsync, nil
+	case "":
+		switch conf.DB.FlushMethod {
+		case 0:
+			return config.FsyncNo, nil
+		case 1:
+			return config.FsyncEverySec, nil
+		case 2:
+			return config.FsyncAlways, nil
+		}
+	}
+	return "", InvalidFsyncPolicyError
+}
+
+// group commits the log: concurrent writers share one fsync, which covers
+// every record written when it starts. Only the fsync is grouped, every
+// record is still written on its own while the engine is locked: a record
+// which fails to be written is never applied, and the written ones survive
+// a crash of the process whatever the fsync policy.
+type group struct {
+	sync.Mutex
+	cond *sync.Cond
+
+	written uint64
+	synced  uint64
+	syncing bool
+}
+
+func newGroup() *group {
+	g := &group{}
+	g.cond = sync.NewCond(g)
+	return g
+}
+
+func (g *group) wrote(lsn uint64) {
+	g.Lock()
+	defer g.Unlock()
+	g.written = lsn
+}
+
+func (g *group) last() uint64 {
+	g.Lock()
+	defer g.Unlock()
+	return g.written
+}
+
+// commit makes the record of lsn durable before a write is acknowledged, as
+// far as the fsync policy asks for it.
+func (s *Storage) commit(lsn uint64) error {
+	if !s.conf.Log.Enable || s.policy != config.FsyncAlways {
+		return nil
+	}
+	err := s.flush(lsn)
+	if err != nil {
+		s.health.fail(err, true)
+	}
+	return err
+}
+
+// flush fsyncs the log until the record of lsn is synced. The first caller
+// finding no fsync running syncs for everyone, the others wait for it.
+func (s *Storage) flush(lsn uint64) error {
+	g := s.fsync
+	g.Lock()
+	defer g.Unlock()
+	for g.synced < lsn && lsn <= g.written {
+		if g.syncing {
+			g.cond.Wait()
+			continue
+		}
+		g.syncing = true
+		target, file := g.written, s.log.file
+		g.Unlock()
+		err := file.Sync()
+		g.Lock()
+		g.syncing = false
+		g.cond.Broadcast()
+		if err != nil {
+			return err
+		}
+		if target > g.synced {
+			g.synced = target
+		}
+	}
+	return nil
+}
+
+// synced returns the lsn up to which the log is known to be durable.
+func (s *Storage) synced() uint64 {
+	g := s.fsync
+	g.Lock()
+	defer g.Unlock()
+	return g.synced
+}
@@ -0,0 +1,416 @@
+package engine
+
+import (
+	"errors"
+	"github.com/awesome-cap/kv/ptl"
+	"math"
+	"math/rand"
+	"strconv"
+)
+
+// maxRandomMembers caps the reply of SRANDMEMBER with a negative count.
+const maxRandomMembers = 1024 * 1024
+
+var (
+	SAdd        = saddHandler{}
+	SRem        = sremHandler{}
+	SIsMember   = sismemberHandler{}
+	SMembers    = smembersHandler{}
+	SCard       = scardHandler{}
+	SPop        = spopHandler{}
+	SRandMember = srandmemberHandler{}
+	SInter      = salgebraHandler{op: inter}
+	SUnion      = salgebraHandler{op: union}
+	SDiff       = salgebraHandler{op: diff}
+	SInterStore = salgebraHandler{op: inter, store: true}
+	SUnionStore = salgebraHandler{op: union, store: true}
+	SDiffStore  = salgebraHandler{op: diff, store: true}
+
+	CountOutRangeError = errors.New("Value is out of range. ")
+)
+
+// set keeps its members in a slice so that random members are picked in
+// O(1), the index maps every member to its position in the slice. The
+// order only depends on the commands applied, which keeps SPOP replayable.
+type set struct {
+	members []string
+	index   map[string]int
+}
+
+func newSet() *set {
+	return &set{index: map[string]int{}}
+}
+
+func (s *set) add(member string) bool {
+	if _, ok := s.index[member]; ok {
+		return false
+	}
+	s.index[member] = len(s.members)
+	s.members = append(s.members, member)
+	return true
+}
+
+func (s *set) remove(member string) bool {
+	i, ok := s.index[member]
+	if !ok {
+		return false
+	}
+	last := len(s.members) - 1
+	s.members[i] = s.members[last]
+	s.index[s.members[i]] = i
+	s.members = s.members[:last]
+	delete(s.index, member)
+	return true
+}
+
+func (s *set) clone() *set {
+	c := &set{members: make([]string, len(s.members)), index: make(map[string]int, len(s.index))}
+	copy(c.members, s.members)
+	for member, i := range s.index {
+		c.index[member] = i
+	}
+	return c
+}
+
+func (s *set) contains(member string) bool {
+	_, ok := s.index[member]
+	return ok
+}
+
+func (s *set) len() int {
+	if s == nil {
+		return 0
+	}
+	return len(s.members)
+}
+
+// splitmix64 is a tiny deterministic generator. SPOP seeds it with the lsn
+// of the command, so that replaying the redo log pops the same members.
+type splitmix64 uint64
+
+func (s *splitmix64) intn(n int) int {
+	*s += 0x9e3779b97f4a7c15
+	z := uint64(*s)
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	z ^= z >> 31
+	return int(z % uint64(n))
+}
+
+// setOf returns the set stored at key, nil if the key does not exist.
+func (e *Engine) setOf(key string) (*set, error) {
+	err := e.assertType(key, typeSet)
+	if err != nil {
+		return nil, err
+	}
+	if e.expired(key) {
+		return nil, nil
+	}
+	v, ok := e.set.Get(key)
+	if !ok {
+		return nil, nil
+	}
+	return v.(*set), nil
+}
+
+// setOrCreate returns the set stored at key, an empty one is created if
+// the key does not exist.
+func (e *Engine) setOrCreate(key string) (*set, error) {
+	s, err := e.setOf(key)
+	if err != nil || s != nil {
+		return s, err
+	}
+	e.Del(key)
+	s = newSet()
+	e.store(e.set, key, s)
+	return s, nil
+}
+
+type saddHandler struct{}
+
+func (h saddHandler) handle(e *Engine, args []string) (ptl.Reply, error) {
+	s, err := e.setOrCreate(args[1])
+	if err != nil {
+		return ptl.Reply{}, err
+	}
+	added := 0
+	for _, member := range args[2:] {
+		if s.add(member) {
+			added++
+		}
+	}
+	return ptl.Integer(int64(added)), nil
+}
+
+func (h saddHandler) size() int    { return 3 }
+func (h saddHandler) name() string { return "sadd" }
+
+type sremHandler struct{}
+
+func (h sremHandler) handle(e *Engine, args []string) (ptl.Reply, error) {
+	s, err := e.setOf(args[1])
+	if err != nil || s == nil {
+		return ptl.Integer(0), err
+	}
+	removed := 0
+	for _, member := range args[2:] {
+		if s.remove(member) {
+			removed++
+		}
+	}
+	if s.len() == 0 {
+		e.Del(args[1])
+	}
+	return ptl.Integer(int64(removed)), nil
+}
+
+func (h sremHandler) size() int    { return 3 }
+func (h sremHandler) name() string { return "srem" }
+
+type sismemberHandler struct{}
+
+func (h sismemberHandler) handle(e *Engine, args []string) (ptl.Reply, error) {
+	s, err := e.setOf(args[1])
+	if err != nil {
+		return ptl.Reply{}, err
+	}
+	if s != nil && s.contains(args[2]) {
+		return ptl.Integer(1), nil
+	}
+	return ptl.Integer(0), nil
+}
+
+func (h sismemberHandler) size() int    { return 3 }
+func (h sismemberHandler) name() string { return "sismember" }
+
+type smembersHandler struct{}
+
+func (h smembersHandler) handle(e *Engine, args []string) (ptl.Reply, error) {
+	s, err := e.setOf(args[1])
+	if err != nil || s == nil {
+		return ptl.Set(nil), err
+	}
+	return ptl.Set(s.members), nil
+}
+
+func (h smembersHandler) size() int    { return 2 }
+func (h smembersHandler) name() string { return "smembers" }
+
+type scardHandler struct{}
+
+func (h scardHandler) handle(e *Engine, args []string) (ptl.Reply, error) {
+	s, err := e.setOf(args[1])
+	if err != nil {
+		return ptl.Reply{}, err
+	}
+	return ptl.Integer(int64(s.len())), nil
+}
+
+func (h scardHandler) size() int    { return 2 }
+func (h scardHandler) name() string { return "scard" }
+
+type spopHandler struct{}
+
+func (h spopHandler) handle(e *Engine, args []string) (ptl.Reply, error) {
+	count := 1
+	if len(args) > 2 {
+		var err error
+		count, err = strconv.Atoi(args[2])
+		if err != nil || count < 0 {
+			return ptl.Reply{}, NotIntegerError
+		}
+	}
+	s, err := e.setOf(args[1])
+	if err != nil {
+		return ptl.Reply{}, err
+	}
+	if s == nil {
+		if len(args) > 2 {
+			return ptl.Array(), nil
+		}
+		return ptl.Nil(), nil
+	}
+	if count > s.len() {
+		count = s.len()
+	}
+	random := splitmix64(e.lsn)
+	results := make([]string, 0, count)
+	for i := 0; i < count && s.len() > 0; i++ {
+		member := s.members[random.intn(s.len())]
+		s.remove(member)
+		results = append(results, member)
+	}
+	if s.len() == 0 {
+		e.Del(args[1])
+	}
+	return members(args, results), nil
+}
+
+func (h spopHandler) size() int    { return 2 }
+func (h spopHandler) name() string { return "spop" }
+
+type srandmemberHandler struct{}
+
+func (h srandmemberHandler) handle(e *Engine, args []string) (ptl.Reply, error) {
+	count := 1
+	if len(args) > 2 {
+		var err error
+		count, err = strconv.Atoi(args[2])
+		if err != nil {
+			return ptl.Reply{}, NotIntegerError
+		}
+		// Like Redis, so that -count can't overflow
+		if count < -math.MaxInt64/2 || count > math.MaxInt64/2 {
+			return ptl.Reply{}, CountOutRangeError
+		}
+	}
+	s, err := e.setOf(args[1])
+	if err != nil {
+		return ptl.Reply{}, err
+	}
+	if s == nil {
+		if len(args) > 2 {
+			return ptl.Array(), nil
+		}
+		return ptl.Nil(), nil
+	}
+	// A negative count allows the same member to be returned many times,
+	// up to maxRandomMembers
+	if count < 0 {
+		count = -count
+		if count > maxRandomMembers {
+			count = maxRandomMembers
+		}
+		results := make([]string, 0)
+		for i := 0; i < count; i++ {
+			results = append(results, s.members[rand.Intn(s.len())])
+		}
+		return ptl.Bulks(results), nil
+	}
+	if count > s.len() {
+		count = s.len()
+	}
+	results := make([]string, 0, count)
+	for _, i := range rand.Perm(s.len())[:count] {
+		results = append(results, s.members[i])
+	}
+	return members(args, results), nil
+}
+
+func (h srandmemberHandler) size() int    { return 2 }
+func (h srandmemberHandler) name() string { return "srandmember" }
+
+// members replies the members picked by SPOP and SRANDMEMBER, a single one
+// unless a count was given.
+func members(args, results []string) ptl.Reply {
+	if len(args) > 2 {
+		return ptl.Bulks(results)
+	}
+	if len(results) == 0 {
+		return ptl.Nil()
+	}
+	return ptl.Bulk(results[0])
+}
+
+type salgebra int
+
+const (
+	inter salgebra = iota
+	union
+	diff
+)
+
+// salgebraHandler computes the intersection, union or difference of sets,
+// the store variants save the result into the first key.
+type salgebraHandler struct {
+	op    salgebra
+	store bool
+}
+
+func (h salgebraHandler) handle(e *Engine, args []string) (ptl.Reply, error) {
+	keys := args[1:]
+	if h.store {
+		keys = args[2:]
+	}
+	sets := make([]*set, len(keys))
+	for i, key := range keys {
+		s, err := e.setOf(key)
+		if err != nil {
+			return ptl.Reply{}, err
+		}
+		sets[i] = s
+	}
+	result := h.compute(sets)
+	if !h.store {
+		return ptl.Set(result.members), nil
+	}
+	e.Del(args[1])
+	if result.len() > 0 {
+		e.store(e.set, args[1], result)
+	}
+	return ptl.Integer(int64(result.len())), nil
+}
+
+// compute iterates the member slices rather than the indexes, so that the
+// order of the result is deterministic.
+func (h salgebraHandler) compute(sets []*set) *set {
+	result := newSet()
+	switch h.op {
+	case inter:
+		smallest := sets[0]
+		for _, s := range sets {
+			if s.len() < smallest.len() {
+				smallest = s
+			}
+		}
+		if smallest.len() == 0 {
+			return result
+		}
+	members:
+		for _, member := range smallest.members {
+			for _, s := range sets {
+				if !s.contains(member) {
+					continue members
+				}
+			}
+			result.add(member)
+		}
+	case union:
+		for _, s := range sets {
+			if s != nil {
+				for _, member := range s.members {
+					result.add(member)
+				}
+			}
+		}
+	case diff:
+		if sets[0] == nil {
+			return result
+		}
+	diffMembers:
+		for _, member := range sets[0].members {
+			for _, s := range sets[1:] {
+				if s != nil && s.contains(member) {
+					continue diffMembers
+				}
+			}
+			result.add(member)
+		}
+	}
+	return result
+}
+
+func (h salgebraHandler) size() int {
+	if h.store {
+		return 3
+	}
+	return 2
+}
+
+func (h salgebraHandler) name() string {
+	name := map[salgebra]string{inter: "sinter", union: "sunion", diff: "sdiff"}[h.op]
+	if h.store {
+		name += "store"
+	}
+	return name
+}
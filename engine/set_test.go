@@ -0,0 +1,129 @@
+package engine
+
+import (
+	"github.com/awesome-cap/kv/ptl"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func TestSPop(t *testing.T) {
+	dir := t.TempDir()
+	e := openEngine(t, dir, true)
+	for i := 0; i < 100; i++ {
+		exec(t, e, "sadd", "s", strconv.Itoa(i))
+	}
+	exec(t, e, "spop", "s")
+	exec(t, e, "spop", "s", "10")
+	members := exec(t, e, "smembers", "s")
+	sort.Strings(members)
+	if len(members) != 89 {
+		t.Fatalf("smembers: want 89 members, got %d", len(members))
+	}
+
+	// Replaying the pops removes the same members
+	e = openEngine(t, dir, true)
+	replayed := exec(t, e, "smembers", "s")
+	sort.Strings(replayed)
+	if !reflect.DeepEqual(replayed, members) {
+		t.Fatalf("smembers after restart: want %v, got %v", members, replayed)
+	}
+
+	// Counts larger than the set pop it all, also when replayed
+	if popped := exec(t, e, "spop", "s", "1000000000000000000"); len(popped) != 89 {
+		t.Fatalf("spop: want 89 members, got %d", len(popped))
+	}
+	e = openEngine(t, dir, true)
+	if n := exec(t, e, "exists", "s")[0]; n != "0" {
+		t.Fatalf("exists: want 0, got %s", n)
+	}
+	if _, err := e.Exec([]string{"spop", "s", "-1"}); err != NotIntegerError {
+		t.Fatalf("spop -1: want %v, got %v", NotIntegerError, err)
+	}
+}
+
+func TestSRandMember(t *testing.T) {
+	e := openEngine(t, t.TempDir(), false)
+	exec(t, e, "sadd", "s", "a", "b", "c")
+	if n := len(exec(t, e, "srandmember", "s", "10")); n != 3 {
+		t.Fatalf("srandmember 10: want 3 members, got %d", n)
+	}
+	if n := len(exec(t, e, "srandmember", "s", "-10")); n != 10 {
+		t.Fatalf("srandmember -10: want 10 members, got %d", n)
+	}
+	if n := len(exec(t, e, "srandmember", "s", "-4611686018427387903")); n != maxRandomMembers {
+		t.Fatalf("srandmember large: want %d members, got %d", maxRandomMembers, n)
+	}
+	for _, count := range []string{"-9223372036854775808", "9223372036854775807"} {
+		if _, err := e.Exec([]string{"srandmember", "s", count}); err != CountOutRangeError {
+			t.Fatalf("srandmember %s: want %v, got %v", count, CountOutRangeError, err)
+		}
+	}
+	if reply, err := e.Exec([]string{"srandmember", "missing"}); err != nil || reply.Type != ptl.NilReply {
+		t.Fatalf("srandmember missing: got (%v, %v)", reply, err)
+	}
+}
+
+func TestSAlgebra(t *testing.T) {
+	dir := t.TempDir()
+	e := openEngine(t, dir, true)
+	exec(t, e, "sadd", "a", "1", "2", "3", "4")
+	exec(t, e, "sadd", "b", "5", "4", "3")
+	exec(t, e, "sadd", "c", "6", "4")
+	for _, c := range []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"sinter", "a", "b", "c"}, []string{"4"}},
+		{[]string{"sinter", "a", "missing"}, []string{}},
+		{[]string{"sunion", "a", "b"}, []string{"1", "2", "3", "4", "5"}},
+		{[]string{"sunion", "missing", "c"}, []string{"4", "6"}},
+		{[]string{"sdiff", "a", "b", "c"}, []string{"1", "2"}},
+		{[]string{"sdiff", "a", "missing"}, []string{"1", "2", "3", "4"}},
+		{[]string{"sdiff", "missing", "a"}, []string{}},
+	} {
+		got := exec(t, e, c.args...)
+		sort.Strings(got)
+		if len(got) != len(c.want) || (len(got) > 0 && !reflect.DeepEqual(got, c.want)) {
+			t.Fatalf("%v: want %v, got %v", c.args, c.want, got)
+		}
+	}
+
+	exec(t, e, "set", "str", "v")
+	for _, name := range []string{"sinter", "sunion", "sdiff", "sinterstore", "sunionstore", "sdiffstore"} {
+		if _, err := e.Exec([]string{name, "a", "str"}); err != WrongTypeError {
+			t.Fatalf("%s: want WrongTypeError, got %v", name, err)
+		}
+	}
+	// The destination is overwritten whatever its type
+	if n := exec(t, e, "sinterstore", "str", "a", "b")[0]; n != "2" {
+		t.Fatalf("sinterstore: want 2, got %s", n)
+	}
+	if typ := exec(t, e, "type", "str")[0]; typ != "set" {
+		t.Fatalf("type: want set, got %s", typ)
+	}
+	// An empty result deletes the destination
+	exec(t, e, "sadd", "empty", "x")
+	if n := exec(t, e, "sdiffstore", "empty", "a", "a")[0]; n != "0" {
+		t.Fatalf("sdiffstore: want 0, got %s", n)
+	}
+	if n := exec(t, e, "exists", "empty")[0]; n != "0" {
+		t.Fatalf("exists: want 0, got %s", n)
+	}
+
+	// Replay stores the members in the same order
+	exec(t, e, "sunionstore", "union", "c", "b", "a")
+	exec(t, e, "sdiffstore", "diff", "a", "c")
+	union, diff := exec(t, e, "smembers", "union"), exec(t, e, "smembers", "diff")
+	e = openEngine(t, dir, true)
+	if got := exec(t, e, "smembers", "union"); !reflect.DeepEqual(got, union) {
+		t.Fatalf("smembers union after restart: want %v, got %v", union, got)
+	}
+	if got := exec(t, e, "smembers", "diff"); !reflect.DeepEqual(got, diff) {
+		t.Fatalf("smembers diff after restart: want %v, got %v", diff, got)
+	}
+	if n := exec(t, e, "exists", "empty")[0]; n != "0" {
+		t.Fatalf("exists after restart: want 0, got %s", n)
+	}
+}
@@ -0,0 +1,187 @@
+package engine
+
+import (
+	"container/list"
+	"encoding/binary"
+	"github.com/awesome-cap/hashmap"
+	"github.com/awesome-cap/kv/ptl"
+	"io"
+	"math"
+)
+
+// snapshot is a point-in-time view of an engine. Taking it only copies the
+// references to the values; writers copy a hash, list, zset or set before
+// changing it while snapshots run, so the values a snapshot refers to never
+// change under it.
+type snapshot struct {
+	lsn       uint64
+	compacted bool
+	entries   map[string][]entry
+}
+
+type entry struct {
+	key   string
+	value interface{}
+}
+
+// capture takes a snapshot of e, which must be locked.
+func (e *Engine) capture() *snapshot {
+	snap := &snapshot{lsn: e.lsn, compacted: e.compacted, entries: map[string][]entry{}}
+	spaces := e.spaces()
+	spaces["expire"] = e.expire
+	spaces["tombstone"] = e.tombstone
+	for name, space := range spaces {
+		entries := make([]entry, 0, space.Size())
+		space.Foreach(func(en *hashmap.Entry) {
+			entries = append(entries, entry{key: en.Key().(string), value: en.Value()})
+		})
+		snap.entries[name] = entries
+	}
+	e.snapshots++
+	e.copied = map[string]bool{}
+	e.fresh = map[string]bool{}
+	return snap
+}
+
+// release ends a snapshot, e must be locked.
+func (e *Engine) release() {
+	e.snapshots--
+	if e.snapshots == 0 {
+		e.copied = nil
+	}
+}
+
+// touch replaces the value of key by a copy before a write changes it in
+// place, if a running snapshot may refer to it. e must be locked.
+func (e *Engine) touch(key string) {
+	if e.copied == nil || e.copied[key] {
+		return
+	}
+	e.copied[key] = true
+	for _, space := range []*hashmap.HashMap{e.hash, e.list, e.zset, e.set} {
+		v, ok := space.Get(key)
+		if !ok {
+			continue
+		}
+		switch value := v.(type) {
+		case map[string]string:
+			space.Set(key, cloneHash(value))
+		case *list.List:
+			space.Set(key, cloneList(value))
+		case *zset:
+			space.Set(key, value.clone())
+		case *set:
+			space.Set(key, value.clone())
+		}
+	}
+}
+
+func (snap *snapshot) marshalTo(writer io.Writer) error {
+	w := &errWriter{Writer: writer}
+	_ = writeHeader(w, dbMagic)
+	lsn := make([]byte, 8)
+	binary.BigEndian.PutUint64(lsn, snap.lsn)
+	_, _ = w.Write(lsn)
+	_ = ptl.WriteUint32(w, ptl.Checksum(lsn))
+	// Marshal string
+	writeSection(w, typeString, func(w io.Writer) {
+		for _, en := range snap.entries[typeString] {
+			value := en.value.(string)
+			_ = ptl.WriteUint16(w, uint16(len(en.key)))
+			_, _ = io.WriteString(w, en.key)
+			_ = ptl.WriteUint64(w, uint64(len(value)))
+			_, _ = io.WriteString(w, value)
+		}
+	})
+	// Marshal hash
+	writeSection(w, typeHash, func(w io.Writer) {
+		for _, en := range snap.entries[typeHash] {
+			fields := en.value.(map[string]string)
+			_ = ptl.WriteUint16(w, uint16(len(en.key)))
+			_, _ = io.WriteString(w, en.key)
+			_ = ptl.WriteUint32(w, uint32(len(fields)))
+			for field, value := range fields {
+				_ = ptl.WriteUint32(w, uint32(len(field)))
+				_, _ = io.WriteString(w, field)
+				_ = ptl.WriteUint64(w, uint64(len(value)))
+				_, _ = io.WriteString(w, value)
+			}
+		}
+	})
+	// Marshal list
+	writeSection(w, typeList, func(w io.Writer) {
+		for _, en := range snap.entries[typeList] {
+			items := en.value.(*list.List)
+			_ = ptl.WriteUint16(w, uint16(len(en.key)))
+			_, _ = io.WriteString(w, en.key)
+			_ = ptl.WriteUint32(w, uint32(items.Len()))
+			for item := items.Front(); item != nil; item = item.Next() {
+				value := item.Value.(string)
+				_ = ptl.WriteUint64(w, uint64(len(value)))
+				_, _ = io.WriteString(w, value)
+			}
+		}
+	})
+	// Marshal zset
+	writeSection(w, typeZSet, func(w io.Writer) {
+		for _, en := range snap.entries[typeZSet] {
+			z := en.value.(*zset)
+			_ = ptl.WriteUint16(w, uint16(len(en.key)))
+			_, _ = io.WriteString(w, en.key)
+			_ = ptl.WriteUint32(w, uint32(z.len()))
+			for node := z.zsl.byRank(1); node != nil; node = node.next() {
+				_ = ptl.WriteUint32(w, uint32(len(node.member)))
+				_, _ = io.WriteString(w, node.member)
+				_ = ptl.WriteUint64(w, math.Float64bits(node.score))
+			}
+		}
+	})
+	// Marshal set
+	writeSection(w, typeSet, func(w io.Writer) {
+		for _, en := range snap.entries[typeSet] {
+			s := en.value.(*set)
+			_ = ptl.WriteUint16(w, uint16(len(en.key)))
+			_, _ = io.WriteString(w, en.key)
+			_ = ptl.WriteUint32(w, uint32(s.len()))
+			for _, member := range s.members {
+				_ = ptl.WriteUint32(w, uint32(len(member)))
+				_, _ = io.WriteString(w, member)
+			}
+		}
+	})
+	// Marshal expire
+	writeSection(w, "expire", func(w io.Writer) {
+		for _, en := range snap.entries["expire"] {
+			_ = ptl.WriteUint16(w, uint16(len(en.key)))
+			_, _ = io.WriteString(w, en.key)
+			_ = ptl.WriteUint64(w, uint64(en.value.(int64)))
+		}
+	})
+	// Marshal tombstone
+	writeSection(w, "tombstone", func(w io.Writer) {
+		for _, en := range snap.entries["tombstone"] {
+			_ = ptl.WriteUint16(w, uint16(len(en.key)))
+			_, _ = io.WriteString(w, en.key)
+		}
+	})
+	if snap.compacted {
+		writeSection(w, "compacted", func(w io.Writer) {})
+	}
+	// An empty section name ends the file
+	_ = ptl.WriteUint16(w, 0)
+	return w.err
+}
+
+// writeSection writes a section followed by its CRC32C checksum. encode is
+// called twice, first to count the size of the data, then to write it.
+func writeSection(w io.Writer, name string, encode func(w io.Writer)) {
+	counter := &countingWriter{}
+	encode(counter)
+	sum := ptl.NewChecksum()
+	mw := io.MultiWriter(w, sum)
+	_ = ptl.WriteUint16(mw, uint16(len(name)))
+	_, _ = io.WriteString(mw, name)
+	_ = ptl.WriteUint64(mw, uint64(counter.n))
+	encode(mw)
+	_ = ptl.WriteUint32(w, sum.Sum32())
+}
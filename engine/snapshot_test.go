@@ -0,0 +1,160 @@
+package engine
+
+import (
+	"bytes"
+	"github.com/awesome-cap/kv/config"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestSnapshotIsolation(t *testing.T) {
+	e := openEngine(t, t.TempDir(), false)
+	exec(t, e, "set", "s", "1")
+	exec(t, e, "hset", "h", "f", "1")
+	exec(t, e, "rpush", "l", "a", "b")
+	exec(t, e, "zadd", "z", "1", "a")
+	exec(t, e, "sadd", "set", "a")
+	exec(t, e, "set", "gone", "1")
+
+	e.Lock()
+	snap := e.capture()
+	e.Unlock()
+	exec(t, e, "set", "s", "2")
+	exec(t, e, "hset", "h", "f", "2", "g", "2")
+	exec(t, e, "rpush", "l", "c")
+	exec(t, e, "lpop", "l")
+	exec(t, e, "zadd", "z", "2", "a", "3", "b")
+	exec(t, e, "sadd", "set", "b")
+	exec(t, e, "del", "gone")
+	exec(t, e, "rename", "s", "moved")
+	exec(t, e, "set", "new", "1")
+	buf := &bytes.Buffer{}
+	if err := snap.marshalTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	e.Lock()
+	e.release()
+	e.Unlock()
+
+	restored := newEngine()
+	if err := restored.UnMarshal(buf); err != nil {
+		t.Fatal(err)
+	}
+	if restored.lsn != 6 {
+		t.Fatalf("lsn: want 6, got %d", restored.lsn)
+	}
+	for key, value := range map[string]string{"s": "1", "gone": "1"} {
+		if v, ok := restored.Get(key); !ok || v != value {
+			t.Fatalf("get %s: want %q, got %q", key, value, v)
+		}
+	}
+	for _, key := range []string{"moved", "new"} {
+		if _, ok := restored.Get(key); ok {
+			t.Fatalf("get %s: want missing", key)
+		}
+	}
+	if fields, _ := restored.hashOf("h"); len(fields) != 1 || fields["f"] != "1" {
+		t.Fatalf("hash: got %v", fields)
+	}
+	if items, _ := restored.listOf("l"); items.Len() != 2 || items.Front().Value != "a" {
+		t.Fatalf("list: got %d items", items.Len())
+	}
+	if z, _ := restored.zsetOf("z"); z.len() != 1 || z.dict["a"] != 1 {
+		t.Fatalf("zset: got %v", z.dict)
+	}
+	if s, _ := restored.setOf("set"); s.len() != 1 {
+		t.Fatalf("set: got %v", s.members)
+	}
+
+	// The live engine kept every write
+	if fields, _ := e.hashOf("h"); len(fields) != 2 || fields["f"] != "2" {
+		t.Fatalf("live hash: got %v", fields)
+	}
+	if e.copied != nil {
+		t.Fatal("copied keys: want none once the snapshot is released")
+	}
+}
+
+// counted sums the counters of an engine, every write of the stress test
+// increments one of them.
+func counted(t *testing.T, e *Engine) int {
+	sum := 0
+	for i := 0; i < 8; i++ {
+		if v, ok := e.Get("c" + strconv.Itoa(i)); ok {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sum += n
+		}
+	}
+	return sum
+}
+
+func TestSnapshotStress(t *testing.T) {
+	dir := t.TempDir()
+	conf := config.Default()
+	conf.Storage.Dir = dir
+	conf.Storage.Log.Fsync = config.FsyncNo
+	e, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const writers, writes = 8, 500
+	wg := sync.WaitGroup{}
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < writes; j++ {
+				if _, err := e.Exec([]string{"incr", "c" + strconv.Itoa((i+j)%8)}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		if err = e.storage.refresh(e); err != nil {
+			t.Fatal(err)
+		}
+		file, err := os.Open(filepath.Join(dir, "a_1.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		snap := newEngine()
+		err = snap.UnMarshal(file)
+		_ = file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sum := counted(t, snap); uint64(sum) != snap.lsn {
+			t.Fatalf("snapshot at lsn %d holds %d writes", snap.lsn, sum)
+		}
+	}
+
+	// Writes after the last snapshot are replayed from the log exactly once
+	exec(t, e, "incr", "c0")
+	recovered, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum := counted(t, recovered); sum != writers*writes+1 {
+		t.Fatalf("recovered %d writes, want %d", sum, writers*writes+1)
+	}
+}
@@ -1,6 +1,7 @@
 package engine
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
 	"github.com/awesome-cap/kv/config"
@@ -8,7 +9,6 @@ import (
 	"github.com/awesome-cap/hashmap"
 	"io"
 	"io/ioutil"
-	xlog "log"
 	"os"
 	"sort"
 	"strconv"
@@ -24,7 +24,9 @@ const (
 	dbFileType           = ".db"
 	dbFileNameFormatter  = "%s_%d.db"
 	logFileType          = ".log"
+	tmpFileType          = ".tmp"
 	logFileNameFormatter = "%s.log"
+	logSegmentFormatter  = "redo_%d.log"
 
 	S state = "s"
 	A state = "a"
@@ -33,6 +35,9 @@ const (
 var (
 	InvalidDBFileNameError = errors.New("Invalid db file name. ")
 	ActiveDBNotExistError  = errors.New("Active db not exist. ")
+
+	InvalidLogFileNameError = errors.New("Invalid log file name. ")
+	InvalidFsyncPolicyError = errors.New("Invalid fsync policy. ")
 )
 
 type dbs []*db
@@ -61,9 +66,11 @@ type db struct {
 	state state
 	name  string
 
-	e    *Engine
-	t    time.Time
 	file *os.File
+	// Index of an archive in the table format, probed tells whether the
+	// format is known yet
+	table  *table
+	probed bool
 }
 
 func (d *db) size() (int64, error) {
@@ -74,9 +81,9 @@ func (d *db) size() (int64, error) {
 	return seed.Size(), nil
 }
 
-func (d *db) open() error {
+func (d *db) open(flag int) error {
 	d.Lock()
-	file, err := os.OpenFile(d.path(), os.O_RDWR|os.O_TRUNC|os.O_CREATE, os.FileMode(0766))
+	file, err := os.OpenFile(d.path(), flag, os.FileMode(0766))
 	if err != nil {
 		return err
 	}
@@ -96,62 +103,46 @@ func (d *db) close() {
 	}
 }
 
-func (d *db) write(data []byte) error {
-	if d.file != nil {
-		_, err := d.file.Write(data)
-		return err
-	}
-	return nil
+// log is a segment of the redo log, holding the records from lsn first on.
+type log struct {
+	first uint64
+	dir   string
+	name  string
+	file  *os.File
 }
 
-func (d *db) stabled() error {
-	err := os.Rename(d.path(), fmt.Sprintf("%s%c%s", d.dir, os.PathSeparator, fmt.Sprintf(dbFileNameFormatter, S, d.seq)))
-	if err != nil {
-		return err
-	}
-	d.state = S
-	return nil
-}
+type Storage struct {
+	sync.RWMutex
 
-func (d *db) engine() (*Engine, error) {
-	e := d.e
-	if e == nil {
-		err := d.open()
-		defer d.close()
-		if err != nil {
-			return nil, err
-		}
-		e = d.e
-		if e == nil {
-			e = &Engine{
-				string: hashmap.New(),
-			}
-			err = e.UnMarshal(d.file)
-			if err != nil {
-				return nil, err
-			}
-			d.e = e
-			d.t = time.Now()
-		}
-	}
-	return e, nil
-}
+	lsn  uint64
+	dbs  dbs
+	log  *log
+	logs logs
 
-type log struct {
-	file *os.File
-}
+	policy string
+	fsync  *group
 
-type Storage struct {
-	lsn uint64
-	dbs dbs
-	log *log
+	refreshing sync.Mutex
+	health     health
+	cache      *cache
+
+	// Closed by halt to stop the daemons
+	stop    chan struct{}
+	halting sync.Once
+	daemons sync.WaitGroup
+	closed  bool
 
 	conf config.Storage
 }
 
 func newStorage(conf config.Storage) (*Storage, error) {
-	s := &Storage{conf: conf}
-	err := s.initialize()
+	policy, err := fsyncPolicy(conf)
+	if err != nil {
+		return nil, err
+	}
+	s := &Storage{conf: conf, policy: policy, fsync: newGroup(), stop: make(chan struct{})}
+	s.cache = newCache(conf.Cache.Size)
+	err = s.initialize()
 	if err != nil {
 		return nil, err
 	}
@@ -174,7 +165,13 @@ func (s *Storage) initialize() error {
 		if info.IsDir() {
 			continue
 		}
-		if strings.HasSuffix(info.Name(), dbFileType) {
+		if strings.HasSuffix(info.Name(), tmpFileType) {
+			// Left by a snapshot write which crashed before its rename
+			err = os.Remove(fmt.Sprintf("%s%c%s", s.conf.Dir, os.PathSeparator, info.Name()))
+			if err != nil {
+				return err
+			}
+		} else if strings.HasSuffix(info.Name(), dbFileType) {
 			info := strings.Split(strings.SplitN(info.Name(), ".", 2)[0], "_")
 			if len(info) != 2 {
 				return InvalidDBFileNameError
@@ -188,24 +185,42 @@ func (s *Storage) initialize() error {
 				return err
 			}
 			s.dbs = append(s.dbs, d)
-		} else if s.log == nil && strings.HasSuffix(info.Name(), logFileType) {
-			logFile, err := s.newLog(info.Name())
+		} else if strings.HasSuffix(info.Name(), logFileType) {
+			l, err := s.segment(info.Name())
 			if err != nil {
 				return err
 			}
-			s.log = logFile
+			s.logs = append(s.logs, l)
 		}
 		sort.Sort(s.dbs)
 	}
-	if s.log == nil {
-		logFile, err := s.newLog(fmt.Sprintf(logFileNameFormatter, "redo"))
-		if err != nil {
-			return err
+	sort.Sort(s.logs)
+	// A crash while filing leaves the active db next to its archive, or
+	// no active db at all
+	archived := map[int64]bool{}
+	for _, d := range s.dbs {
+		if d.state == S {
+			archived[d.seq] = true
 		}
-		s.log = logFile
 	}
-	if s.dbs.Len() == 0 {
-		active, err := s.newDB(A, 1)
+	kept := dbs{}
+	for _, d := range s.dbs {
+		if d.state == A && archived[d.seq] {
+			err = os.Remove(d.path())
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		kept = append(kept, d)
+	}
+	s.dbs = kept
+	if s.dbs.Len() == 0 || s.active().state != A {
+		seq := int64(1)
+		if s.dbs.Len() > 0 {
+			seq = s.active().seq + 1
+		}
+		active, err := s.newDB(A, seq)
 		if err != nil {
 			return err
 		}
@@ -247,74 +262,160 @@ func (s *Storage) newDB(st state, seq int64) (*db, error) {
 	return &db{seq: seq, name: name, state: st, dir: s.conf.Dir}, nil
 }
 
-func (s *Storage) newLog(name string) (*log, error) {
-	path := fmt.Sprintf("%s%c%s", s.conf.Dir, os.PathSeparator, name)
-	err := s.createIfNotExist(path)
-	if err != nil {
-		return nil, err
-	}
-	file, err := os.OpenFile(path, os.O_RDWR|os.O_SYNC, os.FileMode(0766))
-	if err != nil {
-		return nil, err
-	}
-	return &log{file: file}, nil
-}
-
 func (s *Storage) startDaemon(e *Engine) {
-	// Refresh db
+	// Refresh db, failures are retried with backoff
+	s.daemons.Add(1)
 	go func() {
-		interval := s.conf.DB.FlushInterval
-		if interval < 60 {
-			interval = 60
-		}
-		filingSize := s.conf.DB.FilingSize
-		if filingSize < 1048576 {
-			filingSize = 1048576
+		defer s.daemons.Done()
+		interval := time.Duration(s.conf.DB.FlushInterval) * time.Second
+		if interval < time.Minute {
+			interval = time.Minute
 		}
+		wait := interval
 		for {
-			// Sleep interval
-			time.Sleep(time.Duration(interval) * time.Second)
-
-			err := s.refresh(e)
-			if err != nil {
-				xlog.Panicln(err)
-			}
-			size, err := s.active().size()
-			if err != nil {
-				xlog.Panicln(err)
+			timer := time.NewTimer(wait)
+			select {
+			case <-s.stop:
+				timer.Stop()
+				return
+			case <-timer.C:
 			}
-			if size >= filingSize {
-				err = s.filing()
-				if err != nil {
-					xlog.Panicln(err)
-				}
+
+			wait = interval
+			if s.persist(e) != nil {
+				wait = backoff(s.Health().Failures, interval)
 			}
 		}
 	}()
 
-	// Clean db engine
-	go func() {
-		for _, d := range s.dbs {
-			if d.state == S && d.e != nil && time.Now().Before(d.t.Add(5*time.Second)) {
-				d.e = nil
+	// Fsync log
+	if s.conf.Log.Enable && s.policy == config.FsyncEverySec {
+		s.daemons.Add(1)
+		go func() {
+			defer s.daemons.Done()
+			ticker := time.NewTicker(time.Second)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-s.stop:
+					return
+				case <-ticker.C:
+				}
+
+				err := s.flush(s.fsync.last())
+				if err != nil {
+					s.health.fail(err, true)
+				}
 			}
+		}()
+	}
+}
+
+// persist runs maintain and records its outcome, a success leaves read-only
+// mode.
+func (s *Storage) persist(e *Engine) error {
+	err := s.maintain(e)
+	if err != nil {
+		s.health.fail(err, s.health.degraded() || unwritable(err))
+		return err
+	}
+	s.health.recover()
+	return nil
+}
+
+// maintain persists the engine and files or compacts the archives when they
+// grew enough. In read-only mode the log is rotated first, leaving a record
+// torn by the failure at the tail of the old segment.
+func (s *Storage) maintain(e *Engine) error {
+	if s.health.degraded() && !s.conf.DB.Enable {
+		e.Lock()
+		err := s.rotate()
+		e.Unlock()
+		return err
+	}
+	err := s.refresh(e)
+	if err != nil || !s.conf.DB.Enable {
+		return err
+	}
+	filingSize := s.conf.DB.FilingSize
+	if filingSize < 1048576 {
+		filingSize = 1048576
+	}
+	size, err := s.active().size()
+	if err != nil {
+		return err
+	}
+	if size >= filingSize {
+		err = s.filing()
+		if err != nil {
+			return err
 		}
-	}()
+		e.prune(s.holds)
+	}
+	if s.compactable() {
+		return s.compact(e)
+	}
+	return nil
+}
+
+// halt stops the daemons and waits for a running refresh or filing to end.
+func (s *Storage) halt() {
+	s.halting.Do(func() {
+		close(s.stop)
+	})
+	s.daemons.Wait()
 }
 
+// Close stops the daemons, then fsyncs and closes the log. Nothing may be
+// logged afterwards.
+func (s *Storage) Close() error {
+	s.halt()
+	s.Lock()
+	if s.closed {
+		s.Unlock()
+		return nil
+	}
+	s.closed = true
+	for _, d := range s.dbs {
+		d.forget()
+	}
+	s.Unlock()
+	if s.log == nil {
+		return nil
+	}
+	g := s.fsync
+	g.Lock()
+	defer g.Unlock()
+	for g.syncing {
+		g.cond.Wait()
+	}
+	err := s.log.file.Sync()
+	if err == nil {
+		g.synced = g.written
+	}
+	if closeErr := s.log.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// logging writes the record of a command before it is applied, the fsync is
+// left to commit.
 func (s *Storage) logging(args []string) (uint64, error) {
 	lsn := atomic.AddUint64(&s.lsn, 1)
 	if !s.conf.Log.Enable {
 		return lsn, nil
 	}
-	bytes, err := ptl.MarshalWrappedLSN(lsn, args)
+	bytes, err := ptl.MarshalRecord(lsn, args)
 	if err != nil {
 		return lsn, err
 	}
 	_, err = s.log.file.Write(bytes)
 	if err != nil {
+		s.health.fail(err, true)
 		return lsn, err
 	}
+	s.fsync.wrote(lsn)
 	return lsn, nil
 }
 
@@ -326,89 +427,353 @@ func (s *Storage) loadDB(e *Engine) error {
 	if active == nil {
 		return ActiveDBNotExistError
 	}
-	err := active.open()
+	size, err := active.size()
+	if err != nil {
+		return err
+	}
+	// Filing starts an empty active db, while the log was truncated up to
+	// the snapshot it archived: until the next refresh that archive is where
+	// the engine starts from.
+	if n := s.dbs.Len(); size == 0 && n > 1 && s.dbs[n-2].state == S {
+		return s.loadArchive(e, s.dbs[n-2])
+	}
+	err = active.open(os.O_RDONLY)
 	defer active.close()
 	if err != nil {
 		return err
 	}
 	err = e.UnMarshal(active.file)
 	if err != nil && err != io.EOF {
+		return fmt.Errorf("%s: %w", active.path(), err)
+	}
+	return nil
+}
+
+// loadArchive loads the whole content of an archived db into e. The cached
+// engines of archives are shared, so it is loaded on its own.
+func (s *Storage) loadArchive(e *Engine, d *db) error {
+	t, err := s.table(d)
+	if err != nil {
 		return err
 	}
+	if t == nil {
+		err = d.open(os.O_RDONLY)
+		defer d.close()
+		if err == nil {
+			err = e.UnMarshal(d.file)
+		}
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("%s: %w", d.path(), err)
+		}
+	} else {
+		loaded, err := t.load()
+		if err != nil {
+			return fmt.Errorf("%s: %w", d.path(), err)
+		}
+		e.lsn = loaded.lsn
+		e.string, e.hash, e.list, e.zset, e.set = loaded.string, loaded.hash, loaded.list, loaded.zset, loaded.set
+		e.expire, e.tombstone = loaded.expire, loaded.tombstone
+	}
+	// The archive itself stays in place, older ones are still shadowed by it
+	e.compacted = false
 	return nil
 }
 
+// loadLog replays the segments of the redo log which hold records beyond the
+// snapshot, then starts a new segment for the following writes.
 func (s *Storage) loadLog(e *Engine) error {
-	for s.conf.Log.Enable {
-		lsn, args, err := ptl.UnMarshalWrappedLSN(s.log.file)
-		if err != nil {
-			break
+	if !s.conf.Log.Enable {
+		s.lsn = e.lsn
+		return nil
+	}
+	for i, l := range s.logs {
+		if i+1 < s.logs.Len() && s.logs[i+1].first <= e.lsn+1 {
+			continue
 		}
-		if lsn > e.lsn {
-			e.exec(args)
+		err := l.replay(e)
+		if err != nil {
+			return err
 		}
 	}
-	return nil
+	s.lsn = e.lsn
+	s.fsync.written, s.fsync.synced = e.lsn, e.lsn
+	return s.rotate()
 }
 
 func (s *Storage) refresh(e *Engine) error {
 	if !s.conf.DB.Enable {
 		return nil
 	}
+	// Filing replaces the active db, it is read once that can't happen
+	s.refreshing.Lock()
+	defer s.refreshing.Unlock()
+	s.RLock()
 	active := s.active()
+	s.RUnlock()
 	if active == nil {
 		return ActiveDBNotExistError
 	}
-	err := active.open()
-	defer active.close()
+	// The snapshot holds exactly the writes up to its lsn, the later ones go
+	// to a new log segment: both are cut in the same critical section.
+	e.Lock()
+	snap := e.capture()
+	err := s.rotate()
+	e.Unlock()
+	defer func() {
+		e.Lock()
+		e.release()
+		e.Unlock()
+	}()
 	if err != nil {
 		return err
 	}
-	return active.write(e.Marshal())
+	active.Lock()
+	err = s.writeFile(active.path(), snap.marshalTo)
+	active.Unlock()
+	if err != nil {
+		return err
+	}
+	return s.truncate(snap.lsn)
 }
 
+// writeFile replaces the file at path with what write streams, so that a
+// crash leaves either the old or the new content: it goes to a temp file,
+// which is fsynced and renamed over path, then the directory is fsynced to
+// persist the rename.
+func (s *Storage) writeFile(path string, write func(w io.Writer) error) error {
+	tmp := path + tmpFileType
+	file, err := openFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(0766))
+	if err != nil {
+		return err
+	}
+	buf := bufio.NewWriterSize(file, 1<<16)
+	err = write(buf)
+	if err == nil {
+		err = buf.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return syncDir(s.conf.Dir)
+}
+
+// file is the part of *os.File snapshot writes use.
+type file interface {
+	io.Writer
+	Sync() error
+	Close() error
+}
+
+// openFile opens the temp files of snapshot writes, tests replace it to
+// inject faults.
+var openFile = func(name string, flag int, perm os.FileMode) (file, error) {
+	return os.OpenFile(name, flag, perm)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// filing archives the active db as a table and starts a new active db. The
+// table is complete before the active db is removed, a crash in between
+// leaves both, of which initialize keeps the table.
 func (s *Storage) filing() error {
 	if !s.conf.DB.Enable {
 		return nil
 	}
+	s.refreshing.Lock()
+	defer s.refreshing.Unlock()
+	s.RLock()
 	active := s.active()
+	s.RUnlock()
 	if active == nil {
 		return ActiveDBNotExistError
 	}
-	err := active.stabled()
+	e := newEngine()
+	err := active.open(os.O_RDONLY)
+	if err == nil {
+		err = e.UnMarshal(active.file)
+	}
+	active.close()
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("%s: %w", active.path(), err)
+	}
+	archived := &db{seq: active.seq, dir: s.conf.Dir, state: S, name: fmt.Sprintf(dbFileNameFormatter, S, active.seq)}
+	err = s.writeFile(archived.path(), func(w io.Writer) error {
+		return writeTable(w, e)
+	})
 	if err != nil {
 		return err
 	}
-	d, err := s.newDB(A, active.seq+1)
+	next, err := s.newDB(A, active.seq+1)
 	if err != nil {
 		return err
 	}
-	s.dbs = append(s.dbs, d)
-	return nil
+	s.Lock()
+	s.dbs[s.dbs.Len()-1] = archived
+	s.dbs = append(s.dbs, next)
+	s.Unlock()
+	err = os.Remove(active.path())
+	if err != nil {
+		return err
+	}
+	return syncDir(s.conf.Dir)
 }
 
+// foreach visits the archived engines from newest to oldest, until fn reports
+// a result. Archives older than a compacted one are merged into it already.
 func (s *Storage) foreach(fn func(e *Engine) (interface{}, bool)) (interface{}, bool) {
+	s.RLock()
+	defer s.RUnlock()
 	for i := s.dbs.Len() - 1; i >= 0; i-- {
 		d := s.dbs[i]
 		if d.state == S {
-			e, err := d.engine()
+			e, err := s.engine(d)
 			if err != nil {
-				xlog.Panicln(err)
+				// Older archives can't tell what this one shadows
+				s.health.fail(err, false)
+				return nil, false
 			}
 			v, ok := fn(e)
 			if ok {
 				return v, true
 			}
+			if e.compacted {
+				break
+			}
 		}
 	}
 	return nil, false
 }
 
-func (s *Storage) Get(key string) (interface{}, bool) {
+// keys calls fn once for every live string key of the archived dbs, the
+// newest db which knows a key decides whether it is live.
+func (s *Storage) keys(fn func(key string)) {
 	if !s.conf.DB.Enable {
-		return "", false
+		return
+	}
+	shadowed := map[string]bool{}
+	shadow := func(entry *hashmap.Entry) {
+		shadowed[entry.Key().(string)] = true
 	}
-	return s.foreach(func(e *Engine) (interface{}, bool) {
-		return e.Get(key)
+	s.foreach(func(e *Engine) (interface{}, bool) {
+		e.string.Foreach(func(entry *hashmap.Entry) {
+			key := entry.Key().(string)
+			if !shadowed[key] && !e.expired(key) {
+				fn(key)
+			}
+		})
+		for _, space := range e.spaces() {
+			space.Foreach(shadow)
+		}
+		e.tombstone.Foreach(shadow)
+		return nil, false
 	})
 }
+
+// Get looks key up in the archived dbs from newest to oldest.
+func (s *Storage) Get(key string) (interface{}, bool) {
+	v, ok, err := s.lookup(key)
+	if err != nil {
+		// Older archives can't tell what this one shadows
+		s.health.fail(err, false)
+		return "", false
+	}
+	return v, ok
+}
+
+// holds reports whether the archived dbs may hold a live value of key,
+// which the engine has to shadow. An unreadable archive may.
+func (s *Storage) holds(key string) bool {
+	_, ok, err := s.lookup(key)
+	return ok || err != nil
+}
+
+func (s *Storage) lookup(key string) (interface{}, bool, error) {
+	if !s.conf.DB.Enable {
+		return "", false, nil
+	}
+	s.RLock()
+	defer s.RUnlock()
+	for i := s.dbs.Len() - 1; i >= 0; i-- {
+		d := s.dbs[i]
+		if d.state != S {
+			continue
+		}
+		v, ok, compacted, err := s.find(d, key)
+		if err != nil {
+			return "", false, err
+		}
+		if ok {
+			if v == nil {
+				return "", false, nil
+			}
+			return v, true, nil
+		}
+		if compacted {
+			break
+		}
+	}
+	return "", false, nil
+}
+
+// find looks key up in an archived db like Engine.find, it also reports
+// whether the db is compacted. Tables read one block, dbs in the snapshot
+// format are loaded whole.
+func (s *Storage) find(d *db, key string) (interface{}, bool, bool, error) {
+	t, err := s.table(d)
+	if err != nil {
+		return nil, false, false, err
+	}
+	if t != nil {
+		v, ok, err := t.find(key)
+		return v, ok, t.compacted, err
+	}
+	e, err := s.engine(d)
+	if err != nil {
+		return nil, false, false, err
+	}
+	v, ok := e.find(key)
+	return v, ok, e.compacted, nil
+}
+
+// table opens the index of an archived db on first use, it returns nil for
+// a db in the snapshot format.
+func (s *Storage) table(d *db) (*table, error) {
+	d.Lock()
+	defer d.Unlock()
+	if !d.probed {
+		t, err := openTable(d.path())
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", d.path(), err)
+		}
+		d.table, d.probed = t, true
+	}
+	return d.table, nil
+}
+
+// forget closes the index of an archived db whose file was replaced or
+// removed, s must be locked.
+func (d *db) forget() {
+	d.Lock()
+	defer d.Unlock()
+	if d.table != nil {
+		_ = d.table.close()
+	}
+	d.table, d.probed = nil, false
+}
@@ -0,0 +1,855 @@
+package engine
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/awesome-cap/kv/config"
+	"github.com/awesome-cap/kv/ptl"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func openEngine(t *testing.T, dir string, logging bool) *Engine {
+	conf := config.Default()
+	conf.Storage.Dir = dir
+	conf.Storage.Log.Enable = logging
+	e, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func exec(t *testing.T, e *Engine, args ...string) []string {
+	result, err := e.Exec(args)
+	if err != nil {
+		t.Fatalf("%v: %v", args, err)
+	}
+	return result.Strings()
+}
+
+// archive persists the engine and files the active db, as the storage daemon does.
+func archive(t *testing.T, e *Engine) {
+	if err := e.storage.refresh(e); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.storage.filing(); err != nil {
+		t.Fatal(err)
+	}
+	e.prune(e.storage.holds)
+}
+
+func assertGet(t *testing.T, e *Engine, key, value string, found bool) {
+	t.Helper()
+	v, ok := e.Get(key)
+	if ok != found || v != value {
+		t.Fatalf("get %s: want (%q, %v), got (%q, %v)", key, value, found, v, ok)
+	}
+	exists := exec(t, e, "exists", key)[0]
+	if (exists == "1") != found {
+		t.Fatalf("exists %s: want %v, got %s", key, found, exists)
+	}
+}
+
+func TestDelShadowsArchive(t *testing.T) {
+	for _, logging := range []bool{false, true} {
+		dir := t.TempDir()
+		e := openEngine(t, dir, logging)
+		exec(t, e, "set", "k", "v")
+		exec(t, e, "set", "other", "v")
+		archive(t, e)
+		if n := exec(t, e, "del", "k", "missing")[0]; n != "1" {
+			t.Fatalf("del: want 1, got %s", n)
+		}
+		assertGet(t, e, "k", "", false)
+
+		archive(t, e)
+		assertGet(t, e, "k", "", false)
+
+		e = openEngine(t, dir, logging)
+		assertGet(t, e, "k", "", false)
+		assertGet(t, e, "other", "v", true)
+		if keys := exec(t, e, "keys", "*"); len(keys) != 1 || keys[0] != "other" {
+			t.Fatalf("keys: want [other], got %v", keys)
+		}
+	}
+}
+
+func TestTombstones(t *testing.T) {
+	dir := t.TempDir()
+	e := openEngine(t, dir, true)
+	exec(t, e, "set", "k", "v")
+	archive(t, e)
+
+	// Keys no db file holds leave no tombstone
+	exec(t, e, "del", "missing")
+	for i := 0; i < 3; i++ {
+		exec(t, e, "rpush", "queue", "x")
+		exec(t, e, "rpop", "queue")
+	}
+	if e.tombstoned("missing") || e.tombstoned("queue") {
+		t.Fatal("tombstone: want none for new keys")
+	}
+
+	// The snapshot of the key may be filed after it was deleted
+	exec(t, e, "set", "filed", "v")
+	if err := e.storage.refresh(e); err != nil {
+		t.Fatal(err)
+	}
+	exec(t, e, "del", "k", "filed")
+	if !e.tombstoned("k") || !e.tombstoned("filed") {
+		t.Fatal("tombstone: want one for archived keys")
+	}
+	if err := e.storage.filing(); err != nil {
+		t.Fatal(err)
+	}
+	e.prune(e.storage.holds)
+	if !e.tombstoned("k") || !e.tombstoned("filed") {
+		t.Fatal("tombstone: want it kept while an archive holds the key")
+	}
+	assertGet(t, e, "filed", "", false)
+
+	// Once the archives hold tombstones instead, the ones in memory go
+	archive(t, e)
+	if e.tombstoned("k") || e.tombstoned("filed") {
+		t.Fatal("tombstone: want it pruned after filing")
+	}
+	e = openEngine(t, dir, true)
+	assertGet(t, e, "k", "", false)
+	assertGet(t, e, "filed", "", false)
+}
+
+func TestDelShadowsOlderArchives(t *testing.T) {
+	dir := t.TempDir()
+	e := openEngine(t, dir, false)
+	exec(t, e, "set", "k", "1")
+	archive(t, e)
+	exec(t, e, "set", "k", "2")
+	archive(t, e)
+	exec(t, e, "del", "k")
+	archive(t, e)
+	archive(t, e)
+
+	e = openEngine(t, dir, false)
+	assertGet(t, e, "k", "", false)
+	if n := exec(t, e, "dbsize")[0]; n != "0" {
+		t.Fatalf("dbsize: want 0, got %s", n)
+	}
+}
+
+func TestSetAfterDel(t *testing.T) {
+	dir := t.TempDir()
+	e := openEngine(t, dir, true)
+	exec(t, e, "set", "k", "1")
+	archive(t, e)
+	exec(t, e, "del", "k")
+	archive(t, e)
+	exec(t, e, "set", "k", "2")
+	archive(t, e)
+
+	e = openEngine(t, dir, true)
+	assertGet(t, e, "k", "2", true)
+	exec(t, e, "del", "k")
+	exec(t, e, "hset", "k", "f", "v")
+
+	e = openEngine(t, dir, true)
+	if v, ok := e.Get("k"); ok {
+		t.Fatalf("get k: want no string, got %q", v)
+	}
+	if typ := exec(t, e, "type", "k")[0]; typ != "hash" {
+		t.Fatalf("type: want hash, got %s", typ)
+	}
+}
+
+func TestExpiredKeyStaysDeleted(t *testing.T) {
+	dir := t.TempDir()
+	e := openEngine(t, dir, false)
+	exec(t, e, "set", "k", "v")
+	archive(t, e)
+	exec(t, e, "pexpire", "k", "1")
+	time.Sleep(5 * time.Millisecond)
+	e.sweep()
+	if e.inMemory("k") {
+		t.Fatal("sweep: expired key still in memory")
+	}
+	archive(t, e)
+
+	e = openEngine(t, dir, false)
+	assertGet(t, e, "k", "", false)
+}
+
+func TestExpiryReplay(t *testing.T) {
+	dir := t.TempDir()
+	e := openEngine(t, dir, true)
+	exec(t, e, "set", "counter", "5", "px", "1")
+	exec(t, e, "set", "setnx", "old", "px", "1")
+	exec(t, e, "set", "append", "old", "px", "1")
+	exec(t, e, "set", "swept", "old", "px", "1")
+	exec(t, e, "sadd", "set", "m")
+	exec(t, e, "pexpire", "set", "1")
+	time.Sleep(5 * time.Millisecond)
+	if v := exec(t, e, "incr", "counter")[0]; v != "1" {
+		t.Fatalf("incr: want 1, got %s", v)
+	}
+	exec(t, e, "set", "setnx", "new", "nx")
+	exec(t, e, "append", "append", "new")
+	exec(t, e, "sunionstore", "union", "set", "missing")
+	e.sweep()
+	exec(t, e, "set", "swept", "new", "nx")
+
+	// Replaying the log doesn't expire keys, but sees the logged deletes
+	e = openEngine(t, dir, true)
+	assertGet(t, e, "counter", "1", true)
+	assertGet(t, e, "setnx", "new", true)
+	assertGet(t, e, "append", "new", true)
+	assertGet(t, e, "swept", "new", true)
+	if v := exec(t, e, "exists", "union")[0]; v != "0" {
+		t.Fatalf("exists union: want 0, got %s", v)
+	}
+}
+
+func TestRenameSourceStaysDeleted(t *testing.T) {
+	dir := t.TempDir()
+	e := openEngine(t, dir, true)
+	exec(t, e, "set", "src", "v")
+	archive(t, e)
+	exec(t, e, "rename", "src", "dst")
+
+	e = openEngine(t, dir, true)
+	assertGet(t, e, "src", "", false)
+	assertGet(t, e, "dst", "v", true)
+}
+
+func archives(t *testing.T, dir string) []string {
+	names, err := filepath.Glob(filepath.Join(dir, "s_*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+func TestCompact(t *testing.T) {
+	dir := t.TempDir()
+	e := openEngine(t, dir, false)
+	exec(t, e, "set", "a", "1")
+	exec(t, e, "set", "b", "1")
+	exec(t, e, "hset", "h", "f", "v")
+	archive(t, e)
+	exec(t, e, "set", "a", "2")
+	exec(t, e, "del", "b")
+	archive(t, e)
+	exec(t, e, "set", "c", "3")
+	archive(t, e)
+	e.storage.conf.DB.CompactFiles = 3
+	if !e.storage.compactable() {
+		t.Fatal("compactable: want true with three archives")
+	}
+	if err := e.storage.compact(e); err != nil {
+		t.Fatal(err)
+	}
+	if names := archives(t, dir); len(names) != 1 || filepath.Base(names[0]) != "s_3.db" {
+		t.Fatalf("archives: want [s_3.db], got %v", names)
+	}
+	if e.tombstoned("b") {
+		t.Fatal("tombstone of b: want pruned")
+	}
+	if e.storage.compactable() {
+		t.Fatal("compactable: want false with one archive")
+	}
+	if err := e.storage.refresh(e); err != nil {
+		t.Fatal(err)
+	}
+
+	e = openEngine(t, dir, false)
+	assertGet(t, e, "a", "2", true)
+	assertGet(t, e, "b", "", false)
+	assertGet(t, e, "c", "3", true)
+	if n := exec(t, e, "hlen", "h")[0]; n != "1" {
+		t.Fatalf("hlen: want 1, got %s", n)
+	}
+}
+
+func TestCompactedHidesStaleArchives(t *testing.T) {
+	dir := t.TempDir()
+	e := openEngine(t, dir, false)
+	exec(t, e, "set", "k", "v")
+	archive(t, e)
+	exec(t, e, "del", "k")
+	archive(t, e)
+	stale, err := ioutil.ReadFile(filepath.Join(dir, "s_1.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = e.storage.compact(e); err != nil {
+		t.Fatal(err)
+	}
+	// A crash after the rename leaves the merged archives behind
+	if err = ioutil.WriteFile(filepath.Join(dir, "s_1.db"), stale, 0766); err != nil {
+		t.Fatal(err)
+	}
+
+	e = openEngine(t, dir, false)
+	e.tombstone.Del("k")
+	assertGet(t, e, "k", "", false)
+	if err = e.storage.compact(e); err != nil {
+		t.Fatal(err)
+	}
+	if names := archives(t, dir); len(names) != 1 {
+		t.Fatalf("archives: want 1, got %v", names)
+	}
+}
+
+func segments(t *testing.T, dir string) []string {
+	names, err := filepath.Glob(filepath.Join(dir, "*.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range names {
+		names[i] = filepath.Base(name)
+	}
+	return names
+}
+
+func TestLogCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	e := openEngine(t, dir, true)
+	exec(t, e, "set", "a", "1")
+	exec(t, e, "set", "b", "2")
+	if err := e.storage.refresh(e); err != nil {
+		t.Fatal(err)
+	}
+	if names := segments(t, dir); len(names) != 1 || names[0] != "redo_3.log" {
+		t.Fatalf("segments: want [redo_3.log], got %v", names)
+	}
+	exec(t, e, "set", "a", "3")
+	exec(t, e, "del", "b")
+
+	e = openEngine(t, dir, true)
+	assertGet(t, e, "a", "3", true)
+	assertGet(t, e, "b", "", false)
+	exec(t, e, "set", "c", "4")
+	if err := e.storage.refresh(e); err != nil {
+		t.Fatal(err)
+	}
+	if names := segments(t, dir); len(names) != 1 || names[0] != "redo_6.log" {
+		t.Fatalf("segments: want [redo_6.log], got %v", names)
+	}
+
+	e = openEngine(t, dir, true)
+	assertGet(t, e, "a", "3", true)
+	assertGet(t, e, "c", "4", true)
+}
+
+func TestLegacyLogMigration(t *testing.T) {
+	dir := t.TempDir()
+	legacy := make([]byte, 0)
+	for lsn, args := range [][]string{{"set", "a", "1"}, {"set", "b", "2"}, {"del", "a"}} {
+		record, err := ptl.MarshalWrappedLSN(uint64(lsn+1), args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		legacy = append(legacy, record...)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "redo.log"), legacy, 0766); err != nil {
+		t.Fatal(err)
+	}
+
+	e := openEngine(t, dir, true)
+	assertGet(t, e, "a", "", false)
+	assertGet(t, e, "b", "2", true)
+	if names := segments(t, dir); len(names) != 2 || names[0] != "redo_0.log" || names[1] != "redo_4.log" {
+		t.Fatalf("segments: want [redo_0.log redo_4.log], got %v", names)
+	}
+	if err := e.storage.refresh(e); err != nil {
+		t.Fatal(err)
+	}
+	if names := segments(t, dir); len(names) != 1 || names[0] != "redo_4.log" {
+		t.Fatalf("segments: want [redo_4.log], got %v", names)
+	}
+}
+
+func TestLogTornTail(t *testing.T) {
+	dir := t.TempDir()
+	e := openEngine(t, dir, true)
+	exec(t, e, "set", "a", "1")
+	exec(t, e, "set", "b", "2")
+	path := filepath.Join(dir, "redo_1.log")
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err := ptl.MarshalRecord(3, []string{"set", "c", "3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tail := range [][]byte{record[:5], record[:len(record)-1], make([]byte, 64)} {
+		if err = os.Truncate(path, info.Size()); err != nil {
+			t.Fatal(err)
+		}
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0766)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = file.Write(tail)
+		_ = file.Close()
+
+		e = openEngine(t, dir, true)
+		assertGet(t, e, "b", "2", true)
+		assertGet(t, e, "c", "", false)
+		truncated, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if truncated.Size() != info.Size() {
+			t.Fatalf("torn tail: want size %d, got %d", info.Size(), truncated.Size())
+		}
+	}
+}
+
+func TestLogCorruption(t *testing.T) {
+	dir := t.TempDir()
+	e := openEngine(t, dir, true)
+	exec(t, e, "set", "a", "1")
+	exec(t, e, "set", "b", "2")
+	path := filepath.Join(dir, "redo_1.log")
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)/3] ^= 0xff
+	if err = ioutil.WriteFile(path, data, 0766); err != nil {
+		t.Fatal(err)
+	}
+
+	conf := config.Default()
+	conf.Storage.Dir = dir
+	_, err = New(conf)
+	if !errors.Is(err, CorruptedLogError) {
+		t.Fatalf("want %v, got %v", CorruptedLogError, err)
+	}
+}
+
+func TestDBCorruption(t *testing.T) {
+	dir := t.TempDir()
+	e := openEngine(t, dir, false)
+	exec(t, e, "set", "a", "1")
+	if err := e.storage.refresh(e); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "a_1.db")
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, corrupt := range [][]byte{data[:len(data)-1], append(append([]byte{}, data[:30]...), data[31:]...)} {
+		if err = ioutil.WriteFile(path, corrupt, 0766); err != nil {
+			t.Fatal(err)
+		}
+		conf := config.Default()
+		conf.Storage.Dir = dir
+		conf.Storage.Log.Enable = false
+		_, err = New(conf)
+		if !errors.Is(err, CorruptedDBError) {
+			t.Fatalf("want %v, got %v", CorruptedDBError, err)
+		}
+	}
+}
+
+func TestUnversionedDB(t *testing.T) {
+	dir := t.TempDir()
+	section := &bytes.Buffer{}
+	_ = ptl.WriteUint16(section, 1)
+	section.WriteString("k")
+	_ = ptl.WriteUint64(section, 1)
+	section.WriteString("v")
+	legacy := &bytes.Buffer{}
+	_ = ptl.WriteUint64(legacy, 7)
+	_ = ptl.WriteUint16(legacy, uint16(len(typeString)))
+	legacy.WriteString(typeString)
+	_ = ptl.WriteUint64(legacy, uint64(section.Len()))
+	legacy.Write(section.Bytes())
+	if err := ioutil.WriteFile(filepath.Join(dir, "a_1.db"), legacy.Bytes(), 0766); err != nil {
+		t.Fatal(err)
+	}
+
+	e := openEngine(t, dir, false)
+	assertGet(t, e, "k", "v", true)
+	if e.lsn != 7 {
+		t.Fatalf("lsn: want 7, got %d", e.lsn)
+	}
+	if err := e.storage.refresh(e); err != nil {
+		t.Fatal(err)
+	}
+	e = openEngine(t, dir, false)
+	assertGet(t, e, "k", "v", true)
+}
+
+// faultyFile fails once limit bytes are written, like a process killed in the
+// middle of a snapshot write.
+type faultyFile struct {
+	*os.File
+	limit int
+}
+
+func (f *faultyFile) Write(p []byte) (int, error) {
+	if len(p) <= f.limit {
+		n, err := f.File.Write(p)
+		f.limit -= n
+		return n, err
+	}
+	n, _ := f.File.Write(p[:f.limit])
+	f.limit -= n
+	return n, errors.New("injected fault")
+}
+
+func TestSnapshotWriteFault(t *testing.T) {
+	dir := t.TempDir()
+	e := openEngine(t, dir, false)
+	exec(t, e, "set", "a", "1")
+	exec(t, e, "hset", "h", "f", "v")
+	if err := e.storage.refresh(e); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "a_1.db")
+	snapshot, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exec(t, e, "set", "a", "2")
+	exec(t, e, "set", "b", "3")
+	next := e.Marshal()
+
+	defer func(open func(string, int, os.FileMode) (file, error)) {
+		openFile = open
+	}(openFile)
+	for offset := 0; offset < len(next); offset += 7 {
+		openFile = func(name string, flag int, perm os.FileMode) (file, error) {
+			f, err := os.OpenFile(name, flag, perm)
+			if err != nil {
+				return nil, err
+			}
+			return &faultyFile{File: f, limit: offset}, nil
+		}
+		if err = e.storage.refresh(e); err == nil {
+			t.Fatalf("offset %d: want injected fault", offset)
+		}
+		// A killed process leaves its temp file behind
+		if err = ioutil.WriteFile(path+".tmp", next[:offset], 0766); err != nil {
+			t.Fatal(err)
+		}
+		current, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(current, snapshot) {
+			t.Fatalf("offset %d: snapshot changed by a failed write", offset)
+		}
+
+		openFile = func(name string, flag int, perm os.FileMode) (file, error) {
+			return os.OpenFile(name, flag, perm)
+		}
+		recovered := openEngine(t, dir, false)
+		assertGet(t, recovered, "a", "1", true)
+		assertGet(t, recovered, "b", "", false)
+		if n := exec(t, recovered, "hlen", "h")[0]; n != "1" {
+			t.Fatalf("offset %d: hlen: want 1, got %s", offset, n)
+		}
+		if _, err = os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+			t.Fatalf("offset %d: stray temp file not removed", offset)
+		}
+	}
+
+	if err = e.storage.refresh(e); err != nil {
+		t.Fatal(err)
+	}
+	recovered := openEngine(t, dir, false)
+	assertGet(t, recovered, "a", "2", true)
+	assertGet(t, recovered, "b", "3", true)
+}
+
+func TestFsyncPolicy(t *testing.T) {
+	for _, c := range []struct {
+		fsync  string
+		method int
+		policy string
+	}{
+		{"", 0, config.FsyncNo},
+		{"", 1, config.FsyncEverySec},
+		{"", 2, config.FsyncAlways},
+		{config.FsyncAlways, 0, config.FsyncAlways},
+		{config.FsyncNo, 2, config.FsyncNo},
+		{"sometimes", 1, ""},
+		{"", 3, ""},
+	} {
+		conf := config.Default().Storage
+		conf.Log.Fsync, conf.DB.FlushMethod = c.fsync, c.method
+		policy, err := fsyncPolicy(conf)
+		if policy != c.policy || (err != nil) != (c.policy == "") {
+			t.Fatalf("%q/%d: want %q, got %q (%v)", c.fsync, c.method, c.policy, policy, err)
+		}
+	}
+}
+
+func TestGroupCommit(t *testing.T) {
+	dir := t.TempDir()
+	conf := config.Default()
+	conf.Storage.Dir = dir
+	conf.Storage.Log.Fsync = config.FsyncAlways
+	e, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg := sync.WaitGroup{}
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 32; j++ {
+				key := strconv.Itoa(i*32 + j)
+				if _, err := e.Exec([]string{"set", key, key}); err != nil {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if synced := e.storage.synced(); synced != 512 {
+		t.Fatalf("synced lsn: want 512, got %d", synced)
+	}
+	info := strings.Split(exec(t, e, "info")[0], "\r\n")
+	if info[2] != "log_fsync:always" || info[3] != "log_synced_lsn:512" {
+		t.Fatalf("info: got %v", info)
+	}
+
+	e, err = New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := exec(t, e, "dbsize")[0]; n != "512" {
+		t.Fatalf("dbsize: want 512, got %s", n)
+	}
+}
+
+func TestClose(t *testing.T) {
+	for _, logging := range []bool{false, true} {
+		dir := t.TempDir()
+		e := openEngine(t, dir, logging)
+		exec(t, e, "set", "k", "v")
+		blocked := make(chan error, 1)
+		go func() {
+			_, err := e.Exec([]string{"blpop", "list", "0"})
+			blocked <- err
+		}()
+		time.Sleep(50 * time.Millisecond)
+		if err := e.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-blocked; err != ClosedError {
+			t.Fatalf("blpop: want %v, got %v", ClosedError, err)
+		}
+		if _, err := e.Exec([]string{"get", "k"}); err != ClosedError {
+			t.Fatalf("get: want %v, got %v", ClosedError, err)
+		}
+		if err := e.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if logging && len(segments(t, dir)) != 1 {
+			t.Fatalf("segments: want 1, got %v", segments(t, dir))
+		}
+
+		// The final snapshot holds the data without the log
+		e = openEngine(t, dir, false)
+		assertGet(t, e, "k", "v", true)
+	}
+}
+
+func TestCloseWhileFiling(t *testing.T) {
+	dir := t.TempDir()
+	e := openEngine(t, dir, false)
+	exec(t, e, "set", "old", "v")
+	if err := e.storage.refresh(e); err != nil {
+		t.Fatal(err)
+	}
+	exec(t, e, "set", "late", "v")
+
+	// The final snapshot waits for the daemon filing the active db
+	e.storage.daemons.Add(1)
+	closed := make(chan error, 1)
+	go func() {
+		closed <- e.Close()
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if err := e.storage.filing(); err != nil {
+		t.Fatal(err)
+	}
+	e.storage.daemons.Done()
+	if err := <-closed; err != nil {
+		t.Fatal(err)
+	}
+
+	e = openEngine(t, dir, false)
+	assertGet(t, e, "old", "v", true)
+	assertGet(t, e, "late", "v", true)
+}
+
+func TestReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	e := openEngine(t, dir, true)
+	exec(t, e, "set", "a", "1")
+	// Writes to the segment fail like on a full disk
+	file, err := os.Open(e.storage.log.path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	writable := e.storage.log.file
+	e.storage.log.file = file
+	if _, err := e.Exec([]string{"set", "b", "2"}); err == nil {
+		t.Fatal("set: want a write error")
+	}
+	if _, err := e.Exec([]string{"set", "c", "3"}); err != ReadOnlyError {
+		t.Fatalf("set: want %v, got %v", ReadOnlyError, err)
+	}
+	assertGet(t, e, "a", "1", true)
+	health := e.Health()
+	if !health.ReadOnly || health.Failures != 1 || health.LastError == nil {
+		t.Fatalf("health: got %+v", health)
+	}
+	if info := strings.Split(exec(t, e, "info")[0], "\r\n"); info[6] != "storage_status:read_only" {
+		t.Fatalf("info: got %v", info)
+	}
+
+	// The daemon persists the engine into a new segment and leaves read-only mode
+	_ = writable.Close()
+	if err := e.storage.persist(e); err != nil {
+		t.Fatal(err)
+	}
+	if health := e.Health(); health.ReadOnly || health.Failures != 0 {
+		t.Fatalf("health: got %+v", health)
+	}
+	exec(t, e, "set", "c", "3")
+
+	recovered := openEngine(t, dir, true)
+	assertGet(t, recovered, "a", "1", true)
+	assertGet(t, recovered, "b", "", false)
+	assertGet(t, recovered, "c", "3", true)
+}
+
+func TestUnreadableArchive(t *testing.T) {
+	dir := t.TempDir()
+	e := openEngine(t, dir, false)
+	exec(t, e, "set", "other", "v")
+	if err := e.storage.refresh(e); err != nil {
+		t.Fatal(err)
+	}
+	// An archive before the active db, which the restarted engine looks
+	// missing keys up in
+	if err := os.Rename(filepath.Join(dir, "a_1.db"), filepath.Join(dir, "a_2.db")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "s_1.db"), []byte("KVDB\x00\x01garbage"), 0766); err != nil {
+		t.Fatal(err)
+	}
+	e = openEngine(t, dir, false)
+	if v, ok := e.Get("k"); ok {
+		t.Fatalf("get k: want not found, got %q", v)
+	}
+	health := e.Health()
+	if health.ReadOnly || health.LastError == nil {
+		t.Fatalf("health: got %+v", health)
+	}
+	exec(t, e, "set", "other", "v")
+}
+
+func TestArchiveCache(t *testing.T) {
+	dir := t.TempDir()
+	conf := config.Default()
+	conf.Storage.Dir = dir
+	conf.Storage.Log.Enable = false
+	// Every archive holds one key
+	var size int64
+	for i, key := range []string{"a", "b", "c"} {
+		a := newEngine()
+		a.Registry(Set)
+		a.exec([]string{"set", key, strings.Repeat(key, 1000)})
+		data := marshalSorted(t, a)
+		if err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("s_%d.db", i+1)), data, 0766); err != nil {
+			t.Fatal(err)
+		}
+		size = int64(len(data))
+	}
+
+	// Room for two archives
+	conf.Storage.Cache.Size = 2*size + size/2
+	e, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// New read every archive to index their keys, start from an empty cache
+	e.storage.cache = newCache(conf.Storage.Cache.Size)
+	archived := e.storage.archived()
+	for _, i := range []int{0, 1, 0, 2, 0} {
+		a, err := e.storage.engine(archived[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		key := []string{"c", "b", "a"}[i]
+		if v, ok := a.find(key); !ok || v != strings.Repeat(key, 1000) {
+			t.Fatalf("find %s: got (%v, %v)", key, v, ok)
+		}
+	}
+	// Loading the oldest archive evicts the least recently used one
+	stats := e.CacheStats()
+	want := CacheStats{Hits: 2, Misses: 3, Evictions: 1, Entries: 2, Size: 2 * size}
+	if stats != want {
+		t.Fatalf("cache: want %+v, got %+v", want, stats)
+	}
+}
+
+func TestRestartAfterFiling(t *testing.T) {
+	dir := t.TempDir()
+	e := openEngine(t, dir, true)
+	exec(t, e, "set", "s", "1")
+	exec(t, e, "hset", "h", "f", "v")
+	exec(t, e, "rpush", "l", "a", "b")
+	exec(t, e, "sadd", "set", "m")
+	exec(t, e, "zadd", "z", "1", "m")
+	archive(t, e)
+	exec(t, e, "hset", "h", "g", "w")
+	lsn := e.lsn
+
+	// Restarted before the next refresh wrote the new active db
+	e = openEngine(t, dir, true)
+	if e.lsn != lsn {
+		t.Fatalf("lsn: want %d, got %d", lsn, e.lsn)
+	}
+	assertGet(t, e, "s", "1", true)
+	if v := exec(t, e, "hgetall", "h"); len(v) != 4 {
+		t.Fatalf("hgetall: got %v", v)
+	}
+	if v := exec(t, e, "lrange", "l", "0", "-1"); len(v) != 2 || v[1] != "b" {
+		t.Fatalf("lrange: got %v", v)
+	}
+	if v := exec(t, e, "sismember", "set", "m")[0]; v != "1" {
+		t.Fatalf("sismember: got %s", v)
+	}
+	if v := exec(t, e, "zscore", "z", "m"); len(v) != 1 || v[0] != "1" {
+		t.Fatalf("zscore: got %v", v)
+	}
+
+	// An emptied engine is written as such, not taken for a new active db
+	exec(t, e, "del", "s", "h", "l", "set", "z")
+	if err := e.storage.refresh(e); err != nil {
+		t.Fatal(err)
+	}
+	e = openEngine(t, dir, true)
+	if n := exec(t, e, "dbsize")[0]; n != "0" {
+		t.Fatalf("dbsize: want 0, got %s", n)
+	}
+}
@@ -0,0 +1,500 @@
+package engine
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"github.com/awesome-cap/hashmap"
+	"github.com/awesome-cap/kv/ptl"
+	"io"
+	"math"
+	"os"
+	"sort"
+)
+
+// Archived dbs are written as tables: records sorted by key in blocks of
+// about tableBlockSize, each followed by its checksum, then the index of the
+// blocks, a bloom filter of the keys and a fixed size footer. A point lookup
+// reads a single block.
+//
+//	footer: index offset u64, index size u32, bloom offset u64, bloom size u32,
+//	        lsn u64, compacted u8, checksum u32, magic
+//	record: key size u16, key, type u8, deadline flag u8, [deadline u64],
+//	        value size u32, value
+const (
+	tableMagic      = "KVST"
+	tableBlockSize  = 4096
+	tableFooterSize = 8 + 4 + 8 + 4 + 8 + 1 + 4 + len(tableMagic)
+)
+
+// Record types of a table, by their index
+var tableTypes = []string{typeString, typeHash, typeList, typeZSet, typeSet, "tombstone"}
+
+type tableRecord struct {
+	key     string
+	t       string
+	expires bool
+	at      int64
+	value   []byte
+}
+
+type blockHandle struct {
+	first  string
+	offset uint64
+	size   uint32
+}
+
+// writeTable writes the keys of e as a table, e must not change meanwhile.
+func writeTable(writer io.Writer, e *Engine) error {
+	types := map[string]string{}
+	for t, space := range e.spaces() {
+		t := t
+		space.Foreach(func(entry *hashmap.Entry) {
+			types[entry.Key().(string)] = t
+		})
+	}
+	e.tombstone.Foreach(func(entry *hashmap.Entry) {
+		types[entry.Key().(string)] = "tombstone"
+	})
+	keys := make([]string, 0, len(types))
+	for key := range types {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	w := &errWriter{Writer: writer}
+	_ = writeHeader(w, tableMagic)
+	offset := uint64(headerSize)
+	index := make([]blockHandle, 0)
+	filter := newBloom(len(keys))
+	block := &bytes.Buffer{}
+	flush := func() {
+		if block.Len() == 0 {
+			return
+		}
+		index[len(index)-1].size = uint32(block.Len())
+		_, _ = w.Write(block.Bytes())
+		_ = ptl.WriteUint32(w, ptl.Checksum(block.Bytes()))
+		offset += uint64(block.Len()) + 4
+		block.Reset()
+	}
+	for _, key := range keys {
+		if block.Len() == 0 {
+			index = append(index, blockHandle{first: key, offset: offset})
+		}
+		filter.add(key)
+		t := types[key]
+		r := tableRecord{key: key, t: t}
+		if t != "tombstone" {
+			v, _ := e.spaces()[t].Get(key)
+			r.value = encodeValue(v)
+		}
+		if at, ok := e.expire.Get(key); ok {
+			r.expires, r.at = true, at.(int64)
+		}
+		writeRecord(block, r)
+		if block.Len() >= tableBlockSize {
+			flush()
+		}
+	}
+	flush()
+
+	indexData := &bytes.Buffer{}
+	_ = ptl.WriteUint32(indexData, uint32(len(index)))
+	for _, h := range index {
+		_ = ptl.WriteUint16(indexData, uint16(len(h.first)))
+		_, _ = io.WriteString(indexData, h.first)
+		_ = ptl.WriteUint64(indexData, h.offset)
+		_ = ptl.WriteUint32(indexData, h.size)
+	}
+	bloomData := filter.marshal()
+	footer := &bytes.Buffer{}
+	_ = ptl.WriteUint64(footer, offset)
+	_ = ptl.WriteUint32(footer, uint32(indexData.Len()))
+	_ = ptl.WriteUint64(footer, offset+uint64(indexData.Len()))
+	_ = ptl.WriteUint32(footer, uint32(len(bloomData)))
+	_ = ptl.WriteUint64(footer, e.lsn)
+	compacted := byte(0)
+	if e.compacted {
+		compacted = 1
+	}
+	footer.WriteByte(compacted)
+	sum := ptl.NewChecksum()
+	_, _ = sum.Write(indexData.Bytes())
+	_, _ = sum.Write(bloomData)
+	_, _ = sum.Write(footer.Bytes())
+	_ = ptl.WriteUint32(footer, sum.Sum32())
+	footer.WriteString(tableMagic)
+
+	_, _ = w.Write(indexData.Bytes())
+	_, _ = w.Write(bloomData)
+	_, _ = w.Write(footer.Bytes())
+	return w.err
+}
+
+func writeRecord(w *bytes.Buffer, r tableRecord) {
+	_ = ptl.WriteUint16(w, uint16(len(r.key)))
+	w.WriteString(r.key)
+	for i, t := range tableTypes {
+		if t == r.t {
+			w.WriteByte(byte(i))
+		}
+	}
+	if r.expires {
+		w.WriteByte(1)
+		_ = ptl.WriteUint64(w, uint64(r.at))
+	} else {
+		w.WriteByte(0)
+	}
+	_ = ptl.WriteUint32(w, uint32(len(r.value)))
+	w.Write(r.value)
+}
+
+func readRecord(r *bytes.Reader) (tableRecord, error) {
+	record := tableRecord{}
+	keySize, err := ptl.ReadUint16(r)
+	if err != nil {
+		return record, err
+	}
+	key, err := ptl.ReadBytes(r, int(keySize))
+	if err != nil {
+		return record, err
+	}
+	record.key = string(key)
+	t, err := r.ReadByte()
+	if err != nil || int(t) >= len(tableTypes) {
+		return record, CorruptedDBError
+	}
+	record.t = tableTypes[t]
+	expires, err := r.ReadByte()
+	if err != nil {
+		return record, err
+	}
+	if expires == 1 {
+		at, err := ptl.ReadUint64(r)
+		if err != nil {
+			return record, err
+		}
+		record.expires, record.at = true, int64(at)
+	}
+	valueSize, err := ptl.ReadUint32(r)
+	if err != nil {
+		return record, err
+	}
+	record.value, err = ptl.ReadBytes(r, int(valueSize))
+	return record, err
+}
+
+// encodeValue encodes a value the way the snapshot sections do, without the
+// key.
+func encodeValue(v interface{}) []byte {
+	w := &bytes.Buffer{}
+	switch value := v.(type) {
+	case string:
+		w.WriteString(value)
+	case map[string]string:
+		_ = ptl.WriteUint32(w, uint32(len(value)))
+		for field, fv := range value {
+			_ = ptl.WriteUint32(w, uint32(len(field)))
+			w.WriteString(field)
+			_ = ptl.WriteUint64(w, uint64(len(fv)))
+			w.WriteString(fv)
+		}
+	case *list.List:
+		_ = ptl.WriteUint32(w, uint32(value.Len()))
+		for item := value.Front(); item != nil; item = item.Next() {
+			_ = ptl.WriteUint64(w, uint64(len(item.Value.(string))))
+			w.WriteString(item.Value.(string))
+		}
+	case *zset:
+		_ = ptl.WriteUint32(w, uint32(value.len()))
+		for node := value.zsl.byRank(1); node != nil; node = node.next() {
+			_ = ptl.WriteUint32(w, uint32(len(node.member)))
+			w.WriteString(node.member)
+			_ = ptl.WriteUint64(w, math.Float64bits(node.score))
+		}
+	case *set:
+		_ = ptl.WriteUint32(w, uint32(value.len()))
+		for _, member := range value.members {
+			_ = ptl.WriteUint32(w, uint32(len(member)))
+			w.WriteString(member)
+		}
+	}
+	return w.Bytes()
+}
+
+func decodeValue(t string, data []byte) (interface{}, error) {
+	if t == typeString {
+		return string(data), nil
+	}
+	r := bytes.NewReader(data)
+	count, err := ptl.ReadUint32(r)
+	if err != nil {
+		return nil, err
+	}
+	readString := func(size int) (string, error) {
+		b, err := ptl.ReadBytes(r, size)
+		return string(b), err
+	}
+	switch t {
+	case typeHash:
+		fields := make(map[string]string, count)
+		for i := 0; i < int(count); i++ {
+			size, err := ptl.ReadUint32(r)
+			if err != nil {
+				return nil, err
+			}
+			field, err := readString(int(size))
+			if err != nil {
+				return nil, err
+			}
+			valueSize, err := ptl.ReadUint64(r)
+			if err != nil {
+				return nil, err
+			}
+			fields[field], err = readString(int(valueSize))
+			if err != nil {
+				return nil, err
+			}
+		}
+		return fields, nil
+	case typeList:
+		items := list.New()
+		for i := 0; i < int(count); i++ {
+			size, err := ptl.ReadUint64(r)
+			if err != nil {
+				return nil, err
+			}
+			item, err := readString(int(size))
+			if err != nil {
+				return nil, err
+			}
+			items.PushBack(item)
+		}
+		return items, nil
+	case typeZSet:
+		z := newZSet()
+		for i := 0; i < int(count); i++ {
+			size, err := ptl.ReadUint32(r)
+			if err != nil {
+				return nil, err
+			}
+			member, err := readString(int(size))
+			if err != nil {
+				return nil, err
+			}
+			score, err := ptl.ReadUint64(r)
+			if err != nil {
+				return nil, err
+			}
+			z.add(member, math.Float64frombits(score))
+		}
+		return z, nil
+	case typeSet:
+		s := newSet()
+		for i := 0; i < int(count); i++ {
+			size, err := ptl.ReadUint32(r)
+			if err != nil {
+				return nil, err
+			}
+			member, err := readString(int(size))
+			if err != nil {
+				return nil, err
+			}
+			s.add(member)
+		}
+		return s, nil
+	}
+	return nil, CorruptedDBError
+}
+
+// table is an open archived db in the table format, with its index and
+// bloom filter in memory.
+type table struct {
+	file      *os.File
+	size      int64
+	lsn       uint64
+	compacted bool
+	index     []blockHandle
+	bloom     *bloom
+}
+
+// openTable opens the table at path, or returns nil if the file is in the
+// snapshot format.
+func openTable(path string) (*table, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	t, err := readTable(file)
+	if t == nil {
+		_ = file.Close()
+	}
+	return t, err
+}
+
+func readTable(file *os.File) (*table, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, headerSize)
+	if n, _ := file.ReadAt(header, 0); n < headerSize || string(header[:len(tableMagic)]) != tableMagic {
+		return nil, nil
+	}
+	if binary.BigEndian.Uint16(header[len(tableMagic):]) != formatVersion {
+		return nil, UnsupportedVersionError
+	}
+	size := info.Size()
+	if size < int64(headerSize+tableFooterSize) {
+		return nil, CorruptedDBError
+	}
+	footer := make([]byte, tableFooterSize)
+	_, err = file.ReadAt(footer, size-int64(tableFooterSize))
+	if err != nil {
+		return nil, err
+	}
+	if string(footer[tableFooterSize-len(tableMagic):]) != tableMagic {
+		return nil, CorruptedDBError
+	}
+	indexOffset := binary.BigEndian.Uint64(footer[0:])
+	indexSize := binary.BigEndian.Uint32(footer[8:])
+	bloomOffset := binary.BigEndian.Uint64(footer[12:])
+	bloomSize := binary.BigEndian.Uint32(footer[20:])
+	if bloomOffset+uint64(bloomSize) > uint64(size) || indexOffset+uint64(indexSize) != bloomOffset {
+		return nil, CorruptedDBError
+	}
+	meta := make([]byte, uint64(indexSize)+uint64(bloomSize))
+	_, err = file.ReadAt(meta, int64(indexOffset))
+	if err != nil {
+		return nil, err
+	}
+	sum := ptl.NewChecksum()
+	_, _ = sum.Write(meta)
+	_, _ = sum.Write(footer[:33])
+	if sum.Sum32() != binary.BigEndian.Uint32(footer[33:]) {
+		return nil, CorruptedDBError
+	}
+	t := &table{
+		file:      file,
+		size:      size,
+		lsn:       binary.BigEndian.Uint64(footer[24:]),
+		compacted: footer[32] == 1,
+	}
+	t.bloom, err = unMarshalBloom(meta[indexSize:])
+	if err != nil {
+		return nil, err
+	}
+	r := bytes.NewReader(meta[:indexSize])
+	count, err := ptl.ReadUint32(r)
+	if err != nil {
+		return nil, CorruptedDBError
+	}
+	t.index = make([]blockHandle, 0, count)
+	for i := 0; i < int(count); i++ {
+		h := blockHandle{}
+		firstSize, err := ptl.ReadUint16(r)
+		if err != nil {
+			return nil, CorruptedDBError
+		}
+		first, err := ptl.ReadBytes(r, int(firstSize))
+		if err != nil {
+			return nil, CorruptedDBError
+		}
+		h.first = string(first)
+		h.offset, err = ptl.ReadUint64(r)
+		if err != nil {
+			return nil, CorruptedDBError
+		}
+		h.size, err = ptl.ReadUint32(r)
+		if err != nil {
+			return nil, CorruptedDBError
+		}
+		t.index = append(t.index, h)
+	}
+	return t, nil
+}
+
+// block reads the i-th block and checks its checksum.
+func (t *table) block(i int) (*bytes.Reader, error) {
+	h := t.index[i]
+	data := make([]byte, int(h.size)+4)
+	_, err := t.file.ReadAt(data, int64(h.offset))
+	if err != nil {
+		return nil, err
+	}
+	if ptl.Checksum(data[:h.size]) != binary.BigEndian.Uint32(data[h.size:]) {
+		return nil, CorruptedDBError
+	}
+	return bytes.NewReader(data[:h.size]), nil
+}
+
+// find looks key up like Engine.find does, reading the one block which may
+// hold it.
+func (t *table) find(key string) (interface{}, bool, error) {
+	if !t.bloom.has(key) {
+		return nil, false, nil
+	}
+	i := sort.Search(len(t.index), func(i int) bool {
+		return t.index[i].first > key
+	}) - 1
+	if i < 0 {
+		return nil, false, nil
+	}
+	block, err := t.block(i)
+	if err != nil {
+		return nil, false, err
+	}
+	for block.Len() > 0 {
+		r, err := readRecord(block)
+		if err != nil {
+			return nil, false, CorruptedDBError
+		}
+		if r.key < key {
+			continue
+		}
+		if r.key > key {
+			break
+		}
+		if r.t != typeString || r.expires && r.at <= now() {
+			return nil, true, nil
+		}
+		return string(r.value), true, nil
+	}
+	return nil, false, nil
+}
+
+// load reads the whole table into an engine.
+func (t *table) load() (*Engine, error) {
+	e := newEngine()
+	e.lsn, e.compacted = t.lsn, t.compacted
+	for i := range t.index {
+		block, err := t.block(i)
+		if err != nil {
+			return nil, err
+		}
+		for block.Len() > 0 {
+			r, err := readRecord(block)
+			if err != nil {
+				return nil, CorruptedDBError
+			}
+			if r.expires {
+				e.expire.Set(r.key, r.at)
+			}
+			if r.t == "tombstone" {
+				e.tombstone.Set(r.key, true)
+				continue
+			}
+			v, err := decodeValue(r.t, r.value)
+			if err != nil {
+				return nil, CorruptedDBError
+			}
+			e.spaces()[r.t].Set(r.key, v)
+		}
+	}
+	return e, nil
+}
+
+func (t *table) close() error {
+	return t.file.Close()
+}
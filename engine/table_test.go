@@ -0,0 +1,130 @@
+package engine
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestTable(t *testing.T) {
+	e := newEngine()
+	e.Registry(Set, Del, HSet, RPush, ZAdd, SAdd, PExpireAt)
+	for i := 0; i < 2000; i++ {
+		is := strconv.Itoa(i)
+		e.exec([]string{"set", "s" + is, "v" + is})
+	}
+	e.exec([]string{"del", "s7"})
+	e.tombstone.Set("s7", true)
+	e.exec([]string{"hset", "h", "f", "v"})
+	e.exec([]string{"rpush", "l", "a", "b"})
+	e.exec([]string{"zadd", "z", "1.5", "m"})
+	e.exec([]string{"sadd", "set", "m"})
+	e.exec([]string{"pexpireat", "s8", "1"})
+	e.exec([]string{"pexpireat", "s9", strconv.FormatInt(now()+3600000, 10)})
+	e.lsn, e.compacted = 42, true
+
+	path := filepath.Join(t.TempDir(), "s_1.db")
+	buf := &bytes.Buffer{}
+	if err := writeTable(buf, e); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0766); err != nil {
+		t.Fatal(err)
+	}
+	table, err := openTable(path)
+	if err != nil || table == nil {
+		t.Fatalf("open: got (%v, %v)", table, err)
+	}
+	defer table.close()
+	if table.lsn != 42 || !table.compacted || len(table.index) < 2 {
+		t.Fatalf("table: lsn %d, compacted %v, %d blocks", table.lsn, table.compacted, len(table.index))
+	}
+
+	// Lookups agree with the engine, missing keys included
+	for _, key := range []string{"s0", "s1999", "s7", "s8", "s9", "h", "l", "z", "set", "missing", "", "zzz"} {
+		want, wantOK := e.find(key)
+		got, ok, err := table.find(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != wantOK || got != want {
+			t.Fatalf("find %q: want (%v, %v), got (%v, %v)", key, want, wantOK, got, ok)
+		}
+	}
+
+	loaded, err := table.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(marshalSorted(t, loaded), marshalSorted(t, e)) {
+		t.Fatal("load: want the written engine")
+	}
+}
+
+// marshalSorted writes e as a table, which orders the keys.
+func marshalSorted(t *testing.T, e *Engine) []byte {
+	buf := &bytes.Buffer{}
+	if err := writeTable(buf, e); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestTableCorruption(t *testing.T) {
+	e := newEngine()
+	e.Registry(Set)
+	e.exec([]string{"set", "k", "v"})
+	path := filepath.Join(t.TempDir(), "s_1.db")
+	data := marshalSorted(t, e)
+	// Flip a byte of the only block
+	data[headerSize+3] ^= 0xff
+	if err := ioutil.WriteFile(path, data, 0766); err != nil {
+		t.Fatal(err)
+	}
+	table, err := openTable(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.close()
+	if _, _, err := table.find("k"); err != CorruptedDBError {
+		t.Fatalf("find: want %v, got %v", CorruptedDBError, err)
+	}
+}
+
+func TestSnapshotFormatArchive(t *testing.T) {
+	dir := t.TempDir()
+	e := openEngine(t, dir, false)
+	exec(t, e, "set", "old", "1")
+	exec(t, e, "set", "shadowed", "1")
+	if err := e.storage.refresh(e); err != nil {
+		t.Fatal(err)
+	}
+	// Archived the way older versions did, by renaming the active db
+	if err := os.Rename(filepath.Join(dir, "a_1.db"), filepath.Join(dir, "s_1.db")); err != nil {
+		t.Fatal(err)
+	}
+
+	e = openEngine(t, dir, false)
+	assertGet(t, e, "old", "1", true)
+	exec(t, e, "set", "shadowed", "2")
+	exec(t, e, "set", "new", "3")
+	archive(t, e)
+	if table, err := e.storage.table(e.storage.archived()[0]); err != nil || table == nil {
+		t.Fatalf("table of s_2.db: got (%v, %v)", table, err)
+	}
+
+	e.storage.conf.DB.CompactFiles = 2
+	if err := e.storage.compact(e); err != nil {
+		t.Fatal(err)
+	}
+	if table, err := e.storage.table(e.storage.archived()[0]); err != nil || table == nil || !table.compacted {
+		t.Fatalf("compacted table: got (%v, %v)", table, err)
+	}
+	e = openEngine(t, dir, false)
+	assertGet(t, e, "old", "1", true)
+	assertGet(t, e, "shadowed", "2", true)
+	assertGet(t, e, "new", "3", true)
+}
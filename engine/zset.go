@@ -0,0 +1,387 @@
+package engine
+
+import (
+	"errors"
+	"github.com/awesome-cap/kv/ptl"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var (
+	ZAdd          = zaddHandler{}
+	ZRem          = zremHandler{}
+	ZScore        = zscoreHandler{}
+	ZIncrBy       = zincrbyHandler{}
+	ZCard         = zcardHandler{}
+	ZRange        = zrangeHandler{}
+	ZRevRange     = zrangeHandler{rev: true}
+	ZRangeByScore = zrangebyscoreHandler{}
+	ZRank         = zrankHandler{}
+
+	NotFloatError    = errors.New("Value is not a valid float. ")
+	MinMaxFloatError = errors.New("Min or max is not a float. ")
+	NaNScoreError    = errors.New("Resulting score is not a number (NaN). ")
+)
+
+// zset is a sorted set, the dict maps members to their scores and the
+// skiplist keeps them ordered.
+type zset struct {
+	dict map[string]float64
+	zsl  *skiplist
+}
+
+func newZSet() *zset {
+	return &zset{dict: map[string]float64{}, zsl: newSkiplist()}
+}
+
+// add sets the score of member, it returns true if member is new.
+func (z *zset) add(member string, score float64) bool {
+	old, ok := z.dict[member]
+	if ok {
+		if old == score {
+			return false
+		}
+		z.zsl.delete(old, member)
+	}
+	z.dict[member] = score
+	z.zsl.insert(score, member)
+	return !ok
+}
+
+func (z *zset) remove(member string) bool {
+	score, ok := z.dict[member]
+	if !ok {
+		return false
+	}
+	delete(z.dict, member)
+	z.zsl.delete(score, member)
+	return true
+}
+
+func (z *zset) clone() *zset {
+	c := newZSet()
+	for node := z.zsl.byRank(1); node != nil; node = node.next() {
+		c.add(node.member, node.score)
+	}
+	return c
+}
+
+func (z *zset) len() int {
+	return len(z.dict)
+}
+
+func parseScore(arg string) (float64, error) {
+	score, err := strconv.ParseFloat(arg, 64)
+	if err != nil || math.IsNaN(score) {
+		return 0, NotFloatError
+	}
+	return score, nil
+}
+
+func formatScore(score float64) string {
+	switch {
+	case math.IsInf(score, 1):
+		return "inf"
+	case math.IsInf(score, -1):
+		return "-inf"
+	}
+	return strconv.FormatFloat(score, 'g', -1, 64)
+}
+
+// parseBound parses a score range bound, a leading '(' makes it exclusive.
+func parseBound(arg string) (float64, bool, error) {
+	exclusive := strings.HasPrefix(arg, "(")
+	if exclusive {
+		arg = arg[1:]
+	}
+	bound, err := strconv.ParseFloat(arg, 64)
+	if err != nil || math.IsNaN(bound) {
+		return 0, false, MinMaxFloatError
+	}
+	return bound, exclusive, nil
+}
+
+// zsetOf returns the sorted set stored at key, nil if the key does not
+// exist.
+func (e *Engine) zsetOf(key string) (*zset, error) {
+	err := e.assertType(key, typeZSet)
+	if err != nil {
+		return nil, err
+	}
+	if e.expired(key) {
+		return nil, nil
+	}
+	v, ok := e.zset.Get(key)
+	if !ok {
+		return nil, nil
+	}
+	return v.(*zset), nil
+}
+
+// zsetOrCreate returns the sorted set stored at key, an empty one is
+// created if the key does not exist.
+func (e *Engine) zsetOrCreate(key string) (*zset, error) {
+	z, err := e.zsetOf(key)
+	if err != nil || z != nil {
+		return z, err
+	}
+	e.Del(key)
+	z = newZSet()
+	e.store(e.zset, key, z)
+	return z, nil
+}
+
+type zaddHandler struct{}
+
+func (h zaddHandler) handle(e *Engine, args []string) (ptl.Reply, error) {
+	nx, xx := false, false
+	i := 2
+	for ; i < len(args); i++ {
+		option := strings.ToUpper(args[i])
+		if option == "NX" {
+			nx = true
+		} else if option == "XX" {
+			xx = true
+		} else {
+			break
+		}
+	}
+	if (nx && xx) || i == len(args) || (len(args)-i)%2 != 0 {
+		return ptl.Reply{}, SyntaxError
+	}
+	scores := make([]float64, 0, (len(args)-i)/2)
+	for j := i; j < len(args); j += 2 {
+		score, err := parseScore(args[j])
+		if err != nil {
+			return ptl.Reply{}, err
+		}
+		scores = append(scores, score)
+	}
+	z, err := e.zsetOrCreate(args[1])
+	if err != nil {
+		return ptl.Reply{}, err
+	}
+	added := 0
+	for j, score := range scores {
+		member := args[i+j*2+1]
+		if _, ok := z.dict[member]; (ok && nx) || (!ok && xx) {
+			continue
+		}
+		if z.add(member, score) {
+			added++
+		}
+	}
+	if z.len() == 0 {
+		e.Del(args[1])
+	}
+	return ptl.Integer(int64(added)), nil
+}
+
+func (h zaddHandler) size() int    { return 4 }
+func (h zaddHandler) name() string { return "zadd" }
+
+type zremHandler struct{}
+
+func (h zremHandler) handle(e *Engine, args []string) (ptl.Reply, error) {
+	z, err := e.zsetOf(args[1])
+	if err != nil || z == nil {
+		return ptl.Integer(0), err
+	}
+	removed := 0
+	for _, member := range args[2:] {
+		if z.remove(member) {
+			removed++
+		}
+	}
+	if z.len() == 0 {
+		e.Del(args[1])
+	}
+	return ptl.Integer(int64(removed)), nil
+}
+
+func (h zremHandler) size() int    { return 3 }
+func (h zremHandler) name() string { return "zrem" }
+
+type zscoreHandler struct{}
+
+func (h zscoreHandler) handle(e *Engine, args []string) (ptl.Reply, error) {
+	z, err := e.zsetOf(args[1])
+	if err != nil || z == nil {
+		return ptl.Nil(), err
+	}
+	score, ok := z.dict[args[2]]
+	if !ok {
+		return ptl.Nil(), nil
+	}
+	return ptl.Double(formatScore(score)), nil
+}
+
+func (h zscoreHandler) size() int    { return 3 }
+func (h zscoreHandler) name() string { return "zscore" }
+
+type zincrbyHandler struct{}
+
+func (h zincrbyHandler) handle(e *Engine, args []string) (ptl.Reply, error) {
+	incr, err := parseScore(args[2])
+	if err != nil {
+		return ptl.Reply{}, err
+	}
+	z, err := e.zsetOf(args[1])
+	if err != nil {
+		return ptl.Reply{}, err
+	}
+	score := incr
+	if z != nil {
+		if old, ok := z.dict[args[3]]; ok {
+			score += old
+		}
+	}
+	if math.IsNaN(score) {
+		return ptl.Reply{}, NaNScoreError
+	}
+	z, err = e.zsetOrCreate(args[1])
+	if err != nil {
+		return ptl.Reply{}, err
+	}
+	z.add(args[3], score)
+	return ptl.Double(formatScore(score)), nil
+}
+
+func (h zincrbyHandler) size() int    { return 4 }
+func (h zincrbyHandler) name() string { return "zincrby" }
+
+type zcardHandler struct{}
+
+func (h zcardHandler) handle(e *Engine, args []string) (ptl.Reply, error) {
+	z, err := e.zsetOf(args[1])
+	if err != nil || z == nil {
+		return ptl.Integer(0), err
+	}
+	return ptl.Integer(int64(z.len())), nil
+}
+
+func (h zcardHandler) size() int    { return 2 }
+func (h zcardHandler) name() string { return "zcard" }
+
+type zrangeHandler struct {
+	rev bool
+}
+
+func (h zrangeHandler) handle(e *Engine, args []string) (ptl.Reply, error) {
+	start, stop, err := parseRange(args[2:])
+	if err != nil {
+		return ptl.Reply{}, err
+	}
+	withScores := false
+	for _, option := range args[4:] {
+		if strings.ToUpper(option) != "WITHSCORES" {
+			return ptl.Reply{}, SyntaxError
+		}
+		withScores = true
+	}
+	z, err := e.zsetOf(args[1])
+	if err != nil || z == nil {
+		return ptl.Array(), err
+	}
+	start, stop, ok := rangeOf(start, stop, z.len())
+	if !ok {
+		return ptl.Array(), nil
+	}
+	results := make([]string, 0, stop-start+1)
+	node := z.zsl.byRank(start + 1)
+	if h.rev {
+		node = z.zsl.byRank(z.len() - start)
+	}
+	for i := start; i <= stop; i++ {
+		results = append(results, node.member)
+		if withScores {
+			results = append(results, formatScore(node.score))
+		}
+		if h.rev {
+			node = node.prev()
+		} else {
+			node = node.next()
+		}
+	}
+	return ptl.Bulks(results), nil
+}
+
+func (h zrangeHandler) size() int { return 4 }
+func (h zrangeHandler) name() string {
+	if h.rev {
+		return "zrevrange"
+	}
+	return "zrange"
+}
+
+type zrangebyscoreHandler struct{}
+
+func (h zrangebyscoreHandler) handle(e *Engine, args []string) (ptl.Reply, error) {
+	min, minExclusive, err := parseBound(args[2])
+	if err != nil {
+		return ptl.Reply{}, err
+	}
+	max, maxExclusive, err := parseBound(args[3])
+	if err != nil {
+		return ptl.Reply{}, err
+	}
+	withScores, offset, count := false, 0, -1
+	for i := 4; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "WITHSCORES":
+			withScores = true
+		case "LIMIT":
+			if i+2 >= len(args) {
+				return ptl.Reply{}, SyntaxError
+			}
+			offset, count, err = parseRange(args[i+1 : i+3])
+			if err != nil {
+				return ptl.Reply{}, err
+			}
+			i += 2
+		default:
+			return ptl.Reply{}, SyntaxError
+		}
+	}
+	z, err := e.zsetOf(args[1])
+	if err != nil || z == nil || offset < 0 {
+		return ptl.Array(), err
+	}
+	results := make([]string, 0)
+	for node := z.zsl.first(min, minExclusive); node != nil && count != 0; node = node.next() {
+		if node.score > max || (maxExclusive && node.score == max) {
+			break
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		results = append(results, node.member)
+		if withScores {
+			results = append(results, formatScore(node.score))
+		}
+		count--
+	}
+	return ptl.Bulks(results), nil
+}
+
+func (h zrangebyscoreHandler) size() int    { return 4 }
+func (h zrangebyscoreHandler) name() string { return "zrangebyscore" }
+
+type zrankHandler struct{}
+
+func (h zrankHandler) handle(e *Engine, args []string) (ptl.Reply, error) {
+	z, err := e.zsetOf(args[1])
+	if err != nil || z == nil {
+		return ptl.Nil(), err
+	}
+	score, ok := z.dict[args[2]]
+	if !ok {
+		return ptl.Nil(), nil
+	}
+	return ptl.Integer(int64(z.zsl.rank(score, args[2]) - 1)), nil
+}
+
+func (h zrankHandler) size() int    { return 3 }
+func (h zrankHandler) name() string { return "zrank" }
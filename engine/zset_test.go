@@ -0,0 +1,146 @@
+package engine
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSkiplist(t *testing.T) {
+	l := newSkiplist()
+	type item struct {
+		score  float64
+		member string
+	}
+	items := make([]item, 0)
+	for i := 0; i < 500; i++ {
+		it := item{score: float64(rand.Intn(50)), member: strconv.Itoa(i)}
+		items = append(items, it)
+		l.insert(it.score, it.member)
+	}
+	// Delete every third item
+	kept := make([]item, 0)
+	for i, it := range items {
+		if i%3 == 0 {
+			if !l.delete(it.score, it.member) {
+				t.Fatalf("delete %v: want true", it)
+			}
+			continue
+		}
+		kept = append(kept, it)
+	}
+	if l.delete(-1, "missing") || l.delete(items[1].score+0.5, items[1].member) {
+		t.Fatal("delete missing: want false")
+	}
+	sort.Slice(kept, func(i, j int) bool {
+		return kept[i].score < kept[j].score || (kept[i].score == kept[j].score && kept[i].member < kept[j].member)
+	})
+	if l.length != len(kept) {
+		t.Fatalf("length: want %d, got %d", len(kept), l.length)
+	}
+	node := l.head.next()
+	for i, it := range kept {
+		if node == nil || node.score != it.score || node.member != it.member {
+			t.Fatalf("item %d: want %v, got %+v", i, it, node)
+		}
+		if rank := l.rank(it.score, it.member); rank != i+1 {
+			t.Fatalf("rank %v: want %d, got %d", it, i+1, rank)
+		}
+		if byRank := l.byRank(i + 1); byRank != node {
+			t.Fatalf("byRank %d: want %v, got %+v", i+1, it, byRank)
+		}
+		if i > 0 && node.prev().member != kept[i-1].member {
+			t.Fatalf("prev of %v: want %v", it, kept[i-1])
+		}
+		node = node.next()
+	}
+	if node != nil || l.tail.member != kept[len(kept)-1].member {
+		t.Fatal("tail: want the last item")
+	}
+	if l.rank(items[0].score, items[0].member) != 0 || l.byRank(0) != nil || l.byRank(len(kept)+1) != nil {
+		t.Fatal("out of range: want no rank")
+	}
+
+	// first finds the lowest score within the bound
+	for _, min := range []float64{-1, 0, 10, 10.5, 49, 50} {
+		for _, exclusive := range []bool{false, true} {
+			i := sort.Search(len(kept), func(i int) bool {
+				return kept[i].score > min || (!exclusive && kept[i].score == min)
+			})
+			node := l.first(min, exclusive)
+			if i == len(kept) {
+				if node != nil {
+					t.Fatalf("first %v %v: want none, got %+v", min, exclusive, node)
+				}
+				continue
+			}
+			if node == nil || node.member != kept[i].member {
+				t.Fatalf("first %v %v: want %v, got %+v", min, exclusive, kept[i], node)
+			}
+		}
+	}
+}
+
+func TestZSet(t *testing.T) {
+	dir := t.TempDir()
+	e := openEngine(t, dir, true)
+	exec(t, e, "zadd", "z", "1", "a", "2", "b", "2", "c", "3", "d")
+	if n := exec(t, e, "zadd", "z", "nx", "5", "a", "4", "e")[0]; n != "1" {
+		t.Fatalf("zadd nx: want 1, got %s", n)
+	}
+	if n := exec(t, e, "zadd", "z", "xx", "0", "a", "9", "f")[0]; n != "0" {
+		t.Fatalf("zadd xx: want 0, got %s", n)
+	}
+	for _, args := range [][]string{{"zadd", "z", "nx", "xx", "1", "a"}, {"zadd", "z", "1", "a", "2"}} {
+		if _, err := e.Exec(args); err != SyntaxError {
+			t.Fatalf("%v: want SyntaxError, got %v", args, err)
+		}
+	}
+
+	for _, c := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"zrange", "z", "0", "-1"}, "a b c d e"},
+		{[]string{"zrange", "z", "1", "2", "withscores"}, "b 2 c 2"},
+		{[]string{"zrange", "z", "-2", "100"}, "d e"},
+		{[]string{"zrange", "z", "3", "1"}, ""},
+		{[]string{"zrange", "z", "10", "20"}, ""},
+		{[]string{"zrevrange", "z", "0", "1"}, "e d"},
+		{[]string{"zrevrange", "z", "-1", "-1", "withscores"}, "a 0"},
+		{[]string{"zrangebyscore", "z", "2", "3"}, "b c d"},
+		{[]string{"zrangebyscore", "z", "(2", "+inf"}, "d e"},
+		{[]string{"zrangebyscore", "z", "-inf", "(2", "withscores"}, "a 0"},
+		{[]string{"zrangebyscore", "z", "-inf", "+inf", "limit", "1", "2"}, "b c"},
+		{[]string{"zrangebyscore", "z", "0", "10", "limit", "3", "-1"}, "d e"},
+		{[]string{"zrangebyscore", "z", "(3", "(4"}, ""},
+		{[]string{"zrank", "z", "d"}, "3"},
+		{[]string{"zrank", "z", "missing"}, ""},
+		{[]string{"zscore", "z", "b"}, "2"},
+		{[]string{"zincrby", "z", "1.5", "b"}, "3.5"},
+		{[]string{"zrank", "z", "b"}, "3"},
+		{[]string{"zrem", "z", "c", "missing"}, "1"},
+		{[]string{"zcard", "z"}, "4"},
+		{[]string{"zrange", "missing", "0", "-1"}, ""},
+	} {
+		if got := strings.Join(exec(t, e, c.args...), " "); got != c.want {
+			t.Fatalf("%v: want %q, got %q", c.args, c.want, got)
+		}
+	}
+	if _, err := e.Exec([]string{"zrangebyscore", "z", "x", "1"}); err != MinMaxFloatError {
+		t.Fatalf("zrangebyscore x: want MinMaxFloatError, got %v", err)
+	}
+
+	// Removing the last member deletes the key, replay gets the same set
+	exec(t, e, "zadd", "gone", "1", "m")
+	exec(t, e, "zrem", "gone", "m")
+	e = openEngine(t, dir, true)
+	if got := strings.Join(exec(t, e, "zrange", "z", "0", "-1", "withscores"), " "); got != "a 0 d 3 b 3.5 e 4" {
+		t.Fatalf("zrange after restart: got %q", got)
+	}
+	if typ := exec(t, e, "type", "gone")[0]; typ != typeNone {
+		t.Fatalf("type gone: want none, got %s", typ)
+	}
+}
@@ -2,8 +2,16 @@ package net
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"github.com/awesome-cap/kv/ptl"
+	"log"
 	"net"
+	"runtime/debug"
+)
+
+var (
+	InternalError = errors.New("Internal error. ")
 )
 
 type Conn struct {
@@ -25,23 +33,89 @@ func (c *Conn) Read() ([]string, error) {
 }
 
 func (c *Conn) Write(args []string) error {
+	err := c.Send(args)
+	if err != nil {
+		return err
+	}
+	return c.writer.Flush()
+}
+
+// Send buffers a request until Flush.
+func (c *Conn) Send(args []string) error {
 	bytes, err := ptl.Marshal(args)
 	if err != nil {
 		return err
 	}
 	_, err = c.writer.Write(bytes)
+	return err
+}
+
+func (c *Conn) Flush() error {
+	return c.writer.Flush()
+}
+
+func (c *Conn) ReadReply() (ptl.Reply, error) {
+	return ptl.UnMarshalReply(c.reader)
+}
+
+// WriteReply buffers a reply until Flush.
+func (c *Conn) WriteReply(reply ptl.Reply) error {
+	bytes, err := ptl.MarshalReply(reply)
 	if err != nil {
 		return err
 	}
-	return c.writer.Flush()
+	_, err = c.writer.Write(bytes)
+	return err
 }
 
-func (c *Conn) Accept(apply func(args []string, c *Conn)) error {
-	for {
-		args, err := c.Read()
-		if err != nil {
-			return err
+// Accept applies every request read from the connection in order. Requests
+// are read ahead in the background, so that ctx is cancelled as soon as the
+// peer goes away, even while apply is blocked. The replies are flushed once
+// no more requests are waiting.
+func (c *Conn) Accept(apply func(ctx context.Context, args []string, c *Conn)) error {
+	return accept(c.Read, func(ctx context.Context, args []string) {
+		apply(ctx, args, c)
+	}, func(err error) {
+		_ = c.WriteReply(ptl.Error(err.Error()))
+	}, c.Flush)
+}
+
+// accept runs the request loop of a connection, whatever its protocol.
+// Pipelined requests are answered with a single flush.
+func accept(read func() ([]string, error), apply func(ctx context.Context, args []string), fail func(err error), flush func() error) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var err error
+	requests := make(chan []string, 16)
+	go func() {
+		defer close(requests)
+		defer cancel()
+		for {
+			args, readErr := read()
+			if readErr != nil {
+				err = readErr
+				return
+			}
+			requests <- args
+		}
+	}()
+	for args := range requests {
+		safely(ctx, args, apply, fail)
+		if len(requests) == 0 {
+			_ = flush()
 		}
-		apply(args, c)
 	}
+	return err
+}
+
+// safely applies a request, a panic is logged and replied with
+// InternalError through fail, so the connection stays usable.
+func safely(ctx context.Context, args []string, apply func(ctx context.Context, args []string), fail func(err error)) {
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("Panic applying a request: %v\n%s", p, debug.Stack())
+			fail(InternalError)
+		}
+	}()
+	apply(ctx, args)
 }
@@ -1,46 +1,170 @@
 package net
 
 import (
+	"context"
+	"errors"
+	"github.com/awesome-cap/kv/ptl"
 	"io"
 	"log"
 	"net"
+	"sync"
+)
+
+var (
+	ServerClosedError = errors.New("Server closed. ")
 )
 
 type Network interface {
 	Serve(addr ...string) error
 }
 
+// Handler executes a command, ctx is cancelled once its connection is
+// closed.
+type Handler func(ctx context.Context, args []string) (ptl.Reply, error)
+
 type tcp struct {
-	addr string
+	addr  string
+	serve func(conn net.Conn, handle Handler) error
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closing  bool
+	wg       sync.WaitGroup
 }
 
+// NewTcp returns a server speaking the ptl protocol.
 func NewTcp(addr string) *tcp {
-	return &tcp{addr: addr}
+	return &tcp{addr: addr, serve: servePtl, conns: map[net.Conn]struct{}{}}
 }
 
-func (t *tcp) Serve(handle func(args []string) ([]string, error)) error {
+// NewResp returns a server speaking RESP2 and RESP3, for Redis clients.
+func NewResp(addr string) *tcp {
+	return &tcp{addr: addr, serve: serveResp, conns: map[net.Conn]struct{}{}}
+}
+
+func servePtl(conn net.Conn, handle Handler) error {
+	return NewConn(conn).Accept(func(ctx context.Context, args []string, c *Conn) {
+		reply, err := handle(ctx, args)
+		if err != nil {
+			reply = ptl.Error(err.Error())
+		}
+		// A reply too large to frame is answered with the error instead
+		if err := c.WriteReply(reply); err != nil {
+			_ = c.WriteReply(ptl.Error(err.Error()))
+		}
+	})
+}
+
+func serveResp(conn net.Conn, handle Handler) error {
+	c := NewRespConn(conn)
+	err := c.Accept(handle)
+	if c.quit {
+		return nil
+	}
+	if err == RespProtocolError {
+		c.WriteError(err)
+		_ = c.Flush()
+	}
+	return err
+}
+
+// Serve handles every connection in its own goroutine. After Shutdown it
+// returns ServerClosedError.
+func (t *tcp) Serve(handle Handler) error {
 	listener, err := net.Listen("tcp", t.addr)
 	if err != nil {
 		return err
 	}
+	t.mu.Lock()
+	if t.closing {
+		t.mu.Unlock()
+		_ = listener.Close()
+		return ServerClosedError
+	}
+	t.listener = listener
+	t.mu.Unlock()
 	log.Println("Tcp server listening on ", t.addr)
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			if t.closing {
+				return ServerClosedError
+			}
 			return err
 		}
+		if !t.track(conn) {
+			_ = conn.Close()
+			continue
+		}
 		go func() {
-			err = NewConn(conn).Accept(func(args []string, c *Conn) {
-				results, err := handle(args)
-				if err != nil {
-					_ = c.Write([]string{"fail", err.Error()})
-					return
-				}
-				_ = c.Write(append([]string{"ok"}, results...))
-			})
+			defer t.untrack(conn)
+			err := t.serve(conn, handle)
 			if err != nil && err != io.EOF {
 				log.Println(err)
 			}
 		}()
 	}
 }
+
+func (t *tcp) track(conn net.Conn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closing {
+		return false
+	}
+	t.conns[conn] = struct{}{}
+	t.wg.Add(1)
+	return true
+}
+
+func (t *tcp) untrack(conn net.Conn) {
+	t.mu.Lock()
+	delete(t.conns, conn)
+	t.mu.Unlock()
+	_ = conn.Close()
+	t.wg.Done()
+}
+
+// Shutdown stops accepting connections and reading requests, then waits
+// for the commands in flight to be answered. Blocked commands are cancelled.
+// Once ctx is done the remaining connections are closed.
+func (t *tcp) Shutdown(ctx context.Context) error {
+	t.mu.Lock()
+	t.closing = true
+	if t.listener != nil {
+		_ = t.listener.Close()
+	}
+	for conn := range t.conns {
+		closeRead(conn)
+	}
+	t.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		t.mu.Lock()
+		for conn := range t.conns {
+			_ = conn.Close()
+		}
+		t.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// closeRead ends the requests of conn while its replies can still be written.
+func closeRead(conn net.Conn) {
+	if c, ok := conn.(interface{ CloseRead() error }); ok {
+		_ = c.CloseRead()
+		return
+	}
+	_ = conn.Close()
+}
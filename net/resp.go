@@ -0,0 +1,302 @@
+package net
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"github.com/awesome-cap/kv/ptl"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	respMaxArgs     = 1024 * 1024
+	respMaxBulkSize = 512 * 1024 * 1024
+	respMaxLineSize = 64 * 1024
+	// The args of an array are allocated as they arrive beyond this
+	respPreallocArgs = 1024
+)
+
+var (
+	RespProtocolError = errors.New("Protocol error. ")
+)
+
+// RespConn is a connection speaking the Redis serialization protocol, RESP2
+// until the client switches to RESP3 with HELLO.
+type RespConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+	proto  int
+	quit   bool
+}
+
+func NewRespConn(conn net.Conn) *RespConn {
+	return &RespConn{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		writer: bufio.NewWriter(conn),
+		proto:  2,
+	}
+}
+
+// readLine reads a line of at most respMaxLineSize bytes, so that a client
+// can't make it buffer without bounds.
+func (c *RespConn) readLine() (string, error) {
+	var line []byte
+	for {
+		chunk, err := c.reader.ReadSlice('\n')
+		if len(line)+len(chunk) > respMaxLineSize {
+			return "", RespProtocolError
+		}
+		line = append(line, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			if err == io.EOF && len(line) > 0 {
+				return "", io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+		return strings.TrimRight(string(line), "\r\n"), nil
+	}
+}
+
+// Read reads a command, sent as an array of bulk strings or inline. Empty
+// commands are skipped.
+func (c *RespConn) Read() ([]string, error) {
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "*") {
+			if args := strings.Fields(line); len(args) > 0 {
+				return args, nil
+			}
+			continue
+		}
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n > respMaxArgs {
+			return nil, RespProtocolError
+		}
+		if n <= 0 {
+			continue
+		}
+		prealloc := n
+		if prealloc > respPreallocArgs {
+			prealloc = respPreallocArgs
+		}
+		args := make([]string, 0, prealloc)
+		for i := 0; i < n; i++ {
+			line, err = c.readLine()
+			if err != nil {
+				return nil, err
+			}
+			if !strings.HasPrefix(line, "$") {
+				return nil, RespProtocolError
+			}
+			size, err := strconv.Atoi(line[1:])
+			if err != nil || size < 0 || size > respMaxBulkSize {
+				return nil, RespProtocolError
+			}
+			data := make([]byte, size+2)
+			_, err = io.ReadFull(c.reader, data)
+			if err != nil {
+				return nil, err
+			}
+			if string(data[size:]) != "\r\n" {
+				return nil, RespProtocolError
+			}
+			args = append(args, string(data[:size]))
+		}
+		return args, nil
+	}
+}
+
+func (c *RespConn) write(prefix byte, s string) {
+	_ = c.writer.WriteByte(prefix)
+	_, _ = c.writer.WriteString(s)
+	_, _ = c.writer.WriteString("\r\n")
+}
+
+func (c *RespConn) WriteStatus(s string) {
+	c.write('+', s)
+}
+
+// WriteError writes err, prefixed with the generic ERR code unless its
+// message starts with a code like WRONGTYPE.
+func (c *RespConn) WriteError(err error) {
+	msg := strings.TrimSpace(err.Error())
+	if code := strings.SplitN(msg, " ", 2)[0]; code == "" || strings.ToUpper(code) != code {
+		msg = "ERR " + msg
+	}
+	c.write('-', strings.NewReplacer("\r", " ", "\n", " ").Replace(msg))
+}
+
+func (c *RespConn) WriteInteger(i int64) {
+	c.write(':', strconv.FormatInt(i, 10))
+}
+
+func (c *RespConn) WriteBulk(s string) {
+	c.write('$', strconv.Itoa(len(s)))
+	_, _ = c.writer.WriteString(s)
+	_, _ = c.writer.WriteString("\r\n")
+}
+
+// WriteNil writes a missing value, a nil bulk string for RESP2 clients.
+func (c *RespConn) WriteNil() {
+	if c.proto == 3 {
+		c.write('_', "")
+		return
+	}
+	c.write('$', "-1")
+}
+
+// WriteNilArray writes a missing array, a nil array for RESP2 clients.
+func (c *RespConn) WriteNilArray() {
+	if c.proto == 3 {
+		c.write('_', "")
+		return
+	}
+	c.write('*', "-1")
+}
+
+// WriteDouble writes a float, as a bulk string for RESP2 clients.
+func (c *RespConn) WriteDouble(s string) {
+	if c.proto == 3 {
+		c.write(',', s)
+		return
+	}
+	c.WriteBulk(s)
+}
+
+func (c *RespConn) WriteArray(n int) {
+	c.write('*', strconv.Itoa(n))
+}
+
+// WriteMap starts a map of n pairs, an array of 2n items for RESP2 clients.
+func (c *RespConn) WriteMap(n int) {
+	if c.proto == 3 {
+		c.write('%', strconv.Itoa(n))
+		return
+	}
+	c.WriteArray(2 * n)
+}
+
+// WriteSet starts a set of n items, an array for RESP2 clients.
+func (c *RespConn) WriteSet(n int) {
+	if c.proto == 3 {
+		c.write('~', strconv.Itoa(n))
+		return
+	}
+	c.WriteArray(n)
+}
+
+func (c *RespConn) Flush() error {
+	return c.writer.Flush()
+}
+
+// Accept serves the commands of the connection like Conn.Accept, replying
+// to the connection commands itself and passing the others to handle.
+func (c *RespConn) Accept(handle Handler) error {
+	return accept(c.Read, func(ctx context.Context, args []string) {
+		if !c.local(args) {
+			reply, err := handle(ctx, args)
+			if err != nil {
+				reply = ptl.Error(err.Error())
+			}
+			c.WriteReply(reply)
+		}
+	}, c.WriteError, c.Flush)
+}
+
+// local replies to the commands about the connection rather than the data.
+func (c *RespConn) local(args []string) bool {
+	switch strings.ToLower(args[0]) {
+	case "ping":
+		if len(args) > 1 {
+			c.WriteBulk(args[1])
+		} else {
+			c.WriteStatus("PONG")
+		}
+	case "echo":
+		if len(args) != 2 {
+			c.WriteError(errors.New("wrong number of arguments for 'echo' command"))
+		} else {
+			c.WriteBulk(args[1])
+		}
+	case "quit":
+		c.quit = true
+		c.WriteStatus("OK")
+		_ = c.Flush()
+		_ = c.conn.Close()
+	case "select":
+		if len(args) != 2 || args[1] != "0" {
+			c.WriteError(errors.New("DB index is out of range"))
+		} else {
+			c.WriteStatus("OK")
+		}
+	case "client":
+		c.WriteStatus("OK")
+	case "command":
+		c.WriteArray(0)
+	case "hello":
+		c.hello(args)
+	default:
+		return false
+	}
+	return true
+}
+
+// hello switches the protocol version and describes the server.
+func (c *RespConn) hello(args []string) {
+	if len(args) > 1 {
+		proto, err := strconv.Atoi(args[1])
+		if err != nil || proto < 2 || proto > 3 {
+			c.WriteError(errors.New("NOPROTO unsupported protocol version"))
+			return
+		}
+		c.proto = proto
+	}
+	c.WriteMap(3)
+	c.WriteBulk("server")
+	c.WriteBulk("kv")
+	c.WriteBulk("proto")
+	c.WriteInteger(int64(c.proto))
+	c.WriteBulk("mode")
+	c.WriteBulk("standalone")
+}
+
+// WriteReply writes a reply as its RESP type, the RESP3 ones as their RESP2
+// equivalents until the client switches.
+func (c *RespConn) WriteReply(r ptl.Reply) {
+	switch r.Type {
+	case ptl.NilReply:
+		c.WriteNil()
+	case ptl.NilArrayReply:
+		c.WriteNilArray()
+	case ptl.IntegerReply:
+		c.WriteInteger(r.Integer)
+	case ptl.BulkReply:
+		c.WriteBulk(r.Str)
+	case ptl.StatusReply:
+		c.WriteStatus(r.Str)
+	case ptl.ErrorReply:
+		c.WriteError(errors.New(r.Str))
+	case ptl.DoubleReply:
+		c.WriteDouble(r.Str)
+	case ptl.MapReply:
+		c.WriteMap(len(r.Array) / 2)
+	case ptl.SetReply:
+		c.WriteSet(len(r.Array))
+	default:
+		c.WriteArray(len(r.Array))
+	}
+	for _, item := range r.Array {
+		c.WriteReply(item)
+	}
+}
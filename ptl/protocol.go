@@ -3,9 +3,31 @@ package ptl
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
 	"io"
+	"math"
 )
 
+var (
+	TooManyArgsError      = errors.New("Too many args. ")
+	ArgTooLargeError      = errors.New("Arg too large. ")
+	ChecksumMismatchError = errors.New("Checksum mismatch. ")
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Checksum returns the CRC32C checksum of data.
+func Checksum(data []byte) uint32 {
+	return crc32.Checksum(data, castagnoli)
+}
+
+// NewChecksum returns a hash computing the same checksum as Checksum.
+func NewChecksum() hash.Hash32 {
+	return crc32.New(castagnoli)
+}
+
 func WriteUint16(writer io.Writer, i uint16) error {
 	data := make([]byte, 2)
 	binary.BigEndian.PutUint16(data, i)
@@ -84,12 +106,18 @@ func UnMarshal(reader io.Reader) ([]string, error) {
 }
 
 func Marshal(args []string) ([]byte, error) {
+	if len(args) > math.MaxUint16 {
+		return nil, TooManyArgsError
+	}
 	buf := &bytes.Buffer{}
 	err := WriteUint16(buf, uint16(len(args)))
 	if err != nil {
 		return nil, err
 	}
 	for _, data := range args {
+		if uint64(len(data)) > math.MaxUint32 {
+			return nil, ArgTooLargeError
+		}
 		err = WriteUint32(buf, uint32(len(data)))
 		if err != nil {
 			return nil, err
@@ -127,3 +155,52 @@ func UnMarshalWrappedLSN(reader io.Reader) (uint64, []string, error) {
 	}
 	return lsn, args, nil
 }
+
+// MarshalRecord wraps the lsn and args into a record framed as
+// [size u32][crc u32][header crc u32][lsn u64][args], where crc covers the
+// payload and header crc covers size and crc.
+func MarshalRecord(lsn uint64, args []string) ([]byte, error) {
+	payload, err := MarshalWrappedLSN(lsn, args)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(payload)) > math.MaxUint32 {
+		return nil, ArgTooLargeError
+	}
+	buf := &bytes.Buffer{}
+	_ = WriteUint32(buf, uint32(len(payload)))
+	_ = WriteUint32(buf, Checksum(payload))
+	_ = WriteUint32(buf, Checksum(buf.Bytes()))
+	buf.Write(payload)
+	return buf.Bytes(), nil
+}
+
+// UnMarshalRecord reads a record written by MarshalRecord. It returns io.EOF
+// at the end of reader, io.ErrUnexpectedEOF for a partial record and
+// ChecksumMismatchError for a damaged one.
+func UnMarshalRecord(reader io.Reader) (uint64, []string, error) {
+	header := make([]byte, 12)
+	_, err := io.ReadFull(reader, header)
+	if err != nil {
+		return 0, nil, err
+	}
+	if Checksum(header[:8]) != binary.BigEndian.Uint32(header[8:]) {
+		return 0, nil, ChecksumMismatchError
+	}
+	payload := &bytes.Buffer{}
+	_, err = io.CopyN(payload, reader, int64(binary.BigEndian.Uint32(header)))
+	if err == io.EOF {
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	if Checksum(payload.Bytes()) != binary.BigEndian.Uint32(header[4:]) {
+		return 0, nil, ChecksumMismatchError
+	}
+	lsn, args, err := UnMarshalWrappedLSN(payload)
+	if err != nil || payload.Len() > 0 {
+		return 0, nil, ChecksumMismatchError
+	}
+	return lsn, args, nil
+}
@@ -0,0 +1,231 @@
+package ptl
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"strconv"
+)
+
+type ReplyType uint8
+
+// Reply types. Doubles, maps and sets are sent as bulk strings and arrays to
+// clients which don't know them.
+const (
+	NilReply ReplyType = iota
+	IntegerReply
+	BulkReply
+	ArrayReply
+	ErrorReply
+	StatusReply
+	DoubleReply
+	MapReply
+	SetReply
+	NilArrayReply
+)
+
+var (
+	InvalidReplyError = errors.New("Invalid reply. ")
+)
+
+// Reply is the typed result of a command. Integer holds integers, Str the
+// text of bulk strings, statuses, errors and doubles, Array the items of
+// arrays and sets and the keys and values of maps, one after the other.
+type Reply struct {
+	Type    ReplyType
+	Integer int64
+	Str     string
+	Array   []Reply
+}
+
+func Nil() Reply {
+	return Reply{Type: NilReply}
+}
+
+// NilArray replies a missing array, like a blocking pop timing out.
+func NilArray() Reply {
+	return Reply{Type: NilArrayReply}
+}
+
+func Integer(i int64) Reply {
+	return Reply{Type: IntegerReply, Integer: i}
+}
+
+// Bool replies 1 for true and 0 for false.
+func Bool(b bool) Reply {
+	if b {
+		return Integer(1)
+	}
+	return Integer(0)
+}
+
+func Bulk(s string) Reply {
+	return Reply{Type: BulkReply, Str: s}
+}
+
+func Status(s string) Reply {
+	return Reply{Type: StatusReply, Str: s}
+}
+
+func OK() Reply {
+	return Status("OK")
+}
+
+func Error(msg string) Reply {
+	return Reply{Type: ErrorReply, Str: msg}
+}
+
+// Double replies a float, formatted by the caller.
+func Double(s string) Reply {
+	return Reply{Type: DoubleReply, Str: s}
+}
+
+func Array(items ...Reply) Reply {
+	if items == nil {
+		items = []Reply{}
+	}
+	return Reply{Type: ArrayReply, Array: items}
+}
+
+// Bulks replies an array of bulk strings.
+func Bulks(items []string) Reply {
+	return Reply{Type: ArrayReply, Array: bulks(items)}
+}
+
+// Map replies pairs, given as keys and values one after the other.
+func Map(pairs []string) Reply {
+	return Reply{Type: MapReply, Array: bulks(pairs)}
+}
+
+// Set replies an array of distinct bulk strings.
+func Set(items []string) Reply {
+	return Reply{Type: SetReply, Array: bulks(items)}
+}
+
+func bulks(items []string) []Reply {
+	replies := make([]Reply, len(items))
+	for i, item := range items {
+		replies[i] = Bulk(item)
+	}
+	return replies
+}
+
+// String returns the text of a reply, integers formatted in base 10.
+func (r Reply) String() string {
+	if r.Type == IntegerReply {
+		return strconv.FormatInt(r.Integer, 10)
+	}
+	return r.Str
+}
+
+// Strings flattens a reply to its items as text, none for nil.
+func (r Reply) Strings() []string {
+	switch r.Type {
+	case NilReply, NilArrayReply:
+		return nil
+	case ArrayReply, MapReply, SetReply:
+		items := make([]string, 0, len(r.Array))
+		for _, item := range r.Array {
+			items = append(items, item.Strings()...)
+		}
+		return items
+	}
+	return []string{r.String()}
+}
+
+// MarshalReply frames a reply as its type, then an integer, the size and
+// bytes of a text, or the count and items of an array.
+func MarshalReply(r Reply) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	err := writeReply(buf, r)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeReply(buf *bytes.Buffer, r Reply) error {
+	buf.WriteByte(byte(r.Type))
+	switch r.Type {
+	case NilReply, NilArrayReply:
+	case IntegerReply:
+		return WriteUint64(buf, uint64(r.Integer))
+	case BulkReply, ErrorReply, StatusReply, DoubleReply:
+		if uint64(len(r.Str)) > math.MaxUint32 {
+			return ArgTooLargeError
+		}
+		_ = WriteUint32(buf, uint32(len(r.Str)))
+		buf.WriteString(r.Str)
+	case ArrayReply, MapReply, SetReply:
+		if uint64(len(r.Array)) > math.MaxUint32 {
+			return TooManyArgsError
+		}
+		_ = WriteUint32(buf, uint32(len(r.Array)))
+		for _, item := range r.Array {
+			err := writeReply(buf, item)
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		return InvalidReplyError
+	}
+	return nil
+}
+
+func UnMarshalReply(reader io.Reader) (Reply, error) {
+	t, err := ReadBytes(reader, 1)
+	if err != nil {
+		return Reply{}, err
+	}
+	r := Reply{Type: ReplyType(t[0])}
+	switch r.Type {
+	case NilReply, NilArrayReply:
+	case IntegerReply:
+		i, err := ReadUint64(reader)
+		if err != nil {
+			return r, unexpected(err)
+		}
+		r.Integer = int64(i)
+	case BulkReply, ErrorReply, StatusReply, DoubleReply:
+		size, err := ReadUint32(reader)
+		if err != nil {
+			return r, unexpected(err)
+		}
+		data, err := ReadBytes(reader, int(size))
+		if err != nil {
+			return r, unexpected(err)
+		}
+		r.Str = string(data)
+	case ArrayReply, MapReply, SetReply:
+		count, err := ReadUint32(reader)
+		if err != nil {
+			return r, unexpected(err)
+		}
+		// The count is not trusted to allocate ahead
+		capacity := int(count)
+		if capacity > 1024 {
+			capacity = 1024
+		}
+		r.Array = make([]Reply, 0, capacity)
+		for i := 0; i < int(count); i++ {
+			item, err := UnMarshalReply(reader)
+			if err != nil {
+				return r, unexpected(err)
+			}
+			r.Array = append(r.Array, item)
+		}
+	default:
+		return r, InvalidReplyError
+	}
+	return r, nil
+}
+
+// unexpected turns EOF in the middle of a reply into io.ErrUnexpectedEOF.
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -6,8 +6,10 @@ import (
 	"github.com/awesome-cap/kv/engine"
 	"github.com/awesome-cap/kv/net"
 	"log"
+	stdnet "net"
 	"strconv"
 	"testing"
+	"time"
 )
 
 const addr = ":9999"
@@ -22,14 +24,22 @@ func init() {
 
 	go func() {
 		tcpServer := net.NewTcp(addr)
-		err = tcpServer.Serve(func(args []string) ([]string, error) {
-			return e.Exec(args)
-		})
+		err = tcpServer.Serve(e.ExecContext)
 		if err != nil {
 			panic(err)
 		}
 	}()
 
+	// Wait for the server to listen
+	for i := 0; i < 100; i++ {
+		conn, err := stdnet.Dial("tcp", addr)
+		if err == nil {
+			_ = conn.Close()
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
 	c := client.New(addr)
 	connect, err = c.Connect()
 	if err != nil {
@@ -0,0 +1,182 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"github.com/awesome-cap/kv/client"
+	"github.com/awesome-cap/kv/config"
+	"github.com/awesome-cap/kv/engine"
+	"github.com/awesome-cap/kv/net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+const clientAddr = ":9996"
+
+// serve starts a ptl server on clientAddr, stopped at the end of the test.
+func serve(t *testing.T, e *engine.Engine) func() {
+	server := net.NewTcp(clientAddr)
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(e.ExecContext)
+	}()
+	stopped := false
+	stop := func() {
+		if stopped {
+			return
+		}
+		stopped = true
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_ = server.Shutdown(ctx)
+		<-served
+	}
+	t.Cleanup(stop)
+	return stop
+}
+
+func TestClientPool(t *testing.T) {
+	conf := config.Default()
+	conf.Storage.Dir = t.TempDir()
+	e, err := engine.New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	opts := client.DefaultOptions()
+	opts.MaxIdle = 4
+	opts.HealthCheckInterval = 20 * time.Millisecond
+	c := client.NewWithOptions(clientAddr, opts)
+	defer c.Close()
+	// Dial errors come back, after the retries
+	if _, err := c.Cmd(context.Background(), "ping"); err == nil {
+		t.Fatal("cmd: want a dial error without a server")
+	}
+
+	stop := serve(t, e)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if _, err := c.Cmd(context.Background(), "incr", "n"); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if reply, err := c.Cmd(context.Background(), "get", "n"); err != nil || reply.Str != "1600" {
+		t.Fatalf("get: got (%+v, %v)", reply, err)
+	}
+	if stats := c.Stats(); stats.Idle == 0 || stats.Idle > opts.MaxIdle || stats.Active != 0 {
+		t.Fatalf("stats: got %+v", stats)
+	}
+
+	// A blocked command gives up with ctx, its connection is not reused
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.Cmd(ctx, "blpop", "list", "0"); err != context.DeadlineExceeded {
+		t.Fatalf("blpop: want %v, got %v", context.DeadlineExceeded, err)
+	}
+	if stats := c.Stats(); stats.Closes == 0 {
+		t.Fatalf("stats: want the interrupted connection closed, got %+v", stats)
+	}
+
+	// Connections to a restarted server are replaced
+	stop()
+	serve(t, e)
+	time.Sleep(4 * opts.HealthCheckInterval)
+	for i := 0; i < 8; i++ {
+		if _, err := c.Cmd(context.Background(), "set", "k"+strconv.Itoa(i), "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats := c.Stats(); stats.Stale == 0 {
+		t.Fatalf("stats: want stale connections, got %+v", stats)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Cmd(context.Background(), "ping"); err != client.ClientClosedError {
+		t.Fatalf("cmd: want %v, got %v", client.ClientClosedError, err)
+	}
+}
+
+func TestClientCommands(t *testing.T) {
+	ctx := context.Background()
+	c := client.New(addr)
+	defer c.Close()
+	if _, err := c.Del(ctx, "cmd:k", "cmd:n", "cmd:h", "cmd:l"); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, ok, err := c.Get(ctx, "cmd:k"); err != nil || ok || v != "" {
+		t.Fatalf("get missing: got (%q, %v, %v)", v, ok, err)
+	}
+	if ok, err := c.Set(ctx, "cmd:k", "", client.SetOptions{}); err != nil || !ok {
+		t.Fatalf("set: got (%v, %v)", ok, err)
+	}
+	if v, ok, err := c.Get(ctx, "cmd:k"); err != nil || !ok || v != "" {
+		t.Fatalf("get empty: got (%q, %v, %v)", v, ok, err)
+	}
+	if ok, err := c.Set(ctx, "cmd:k", "v", client.SetOptions{NX: true}); err != nil || ok {
+		t.Fatalf("set nx: got (%v, %v)", ok, err)
+	}
+	if ttl, ok, err := c.TTL(ctx, "cmd:k"); err != nil || !ok || ttl != client.NoDeadline {
+		t.Fatalf("ttl: got (%v, %v, %v)", ttl, ok, err)
+	}
+	if ok, err := c.Expire(ctx, "cmd:k", time.Minute); err != nil || !ok {
+		t.Fatalf("expire: got (%v, %v)", ok, err)
+	}
+	if ttl, ok, err := c.TTL(ctx, "cmd:k"); err != nil || !ok || ttl <= 0 || ttl > time.Minute {
+		t.Fatalf("ttl: got (%v, %v, %v)", ttl, ok, err)
+	}
+	if n, err := c.Exists(ctx, "cmd:k", "cmd:n"); err != nil || n != 1 {
+		t.Fatalf("exists: got (%d, %v)", n, err)
+	}
+	if n, err := c.IncrBy(ctx, "cmd:n", 41); err != nil || n != 41 {
+		t.Fatalf("incrby: got (%d, %v)", n, err)
+	}
+	if n, err := c.Incr(ctx, "cmd:n"); err != nil || n != 42 {
+		t.Fatalf("incr: got (%d, %v)", n, err)
+	}
+
+	if ok, err := c.HSet(ctx, "cmd:h", "f", "v"); err != nil || !ok {
+		t.Fatalf("hset: got (%v, %v)", ok, err)
+	}
+	if v, ok, err := c.HGet(ctx, "cmd:h", "f"); err != nil || !ok || v != "v" {
+		t.Fatalf("hget: got (%q, %v, %v)", v, ok, err)
+	}
+	if m, err := c.HGetAll(ctx, "cmd:h"); err != nil || len(m) != 1 || m["f"] != "v" {
+		t.Fatalf("hgetall: got (%v, %v)", m, err)
+	}
+	if n, err := c.RPush(ctx, "cmd:l", "a", "b", "c"); err != nil || n != 3 {
+		t.Fatalf("rpush: got (%d, %v)", n, err)
+	}
+	if items, err := c.LRange(ctx, "cmd:l", 0, -1); err != nil || len(items) != 3 || items[2] != "c" {
+		t.Fatalf("lrange: got (%v, %v)", items, err)
+	}
+	if v, ok, err := c.LPop(ctx, "cmd:l"); err != nil || !ok || v != "a" {
+		t.Fatalf("lpop: got (%q, %v, %v)", v, ok, err)
+	}
+
+	// Errors replied by the server are typed, nil replies are told apart
+	_, err := c.LPush(ctx, "cmd:h", "x")
+	var serverErr *client.ServerError
+	if !errors.As(err, &serverErr) {
+		t.Fatalf("lpush hash: want a server error, got %v", err)
+	}
+	if _, err := client.String(c.Cmd(ctx, "get", "cmd:missing")); err != client.NilError {
+		t.Fatalf("get missing: want %v, got %v", client.NilError, err)
+	}
+	if n, err := c.Del(ctx, "cmd:k", "cmd:n", "cmd:h", "cmd:l", "cmd:missing"); err != nil || n != 4 {
+		t.Fatalf("del: got (%d, %v)", n, err)
+	}
+}
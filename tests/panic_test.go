@@ -0,0 +1,68 @@
+package tests
+
+import (
+	"bufio"
+	"context"
+	"github.com/awesome-cap/kv/client"
+	"github.com/awesome-cap/kv/net"
+	"github.com/awesome-cap/kv/ptl"
+	stdnet "net"
+	"testing"
+	"time"
+)
+
+// panicky panics on BOOM and echoes the other commands.
+func panicky(ctx context.Context, args []string) (ptl.Reply, error) {
+	if args[0] == "BOOM" {
+		panic("boom")
+	}
+	return ptl.Bulk(args[0]), nil
+}
+
+func dial(t *testing.T, addr string) stdnet.Conn {
+	var conn stdnet.Conn
+	var err error
+	for i := 0; i < 100; i++ {
+		if conn, err = stdnet.Dial("tcp", addr); err == nil {
+			return conn
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal(err)
+	return nil
+}
+
+func TestPanicReplied(t *testing.T) {
+	const ptlAddr, respAddr = ":9994", ":9995"
+	tcpServer, respServer := net.NewTcp(ptlAddr), net.NewResp(respAddr)
+	go func() {
+		_ = tcpServer.Serve(panicky)
+	}()
+	go func() {
+		_ = respServer.Serve(panicky)
+	}()
+	defer tcpServer.Shutdown(context.Background())
+	defer respServer.Shutdown(context.Background())
+
+	// The connection goes on serving the requests following the panic
+	_ = dial(t, ptlAddr).Close()
+	connect, err := client.New(ptlAddr).Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connect.Close()
+	if _, err := connect.Cmd("BOOM"); err == nil || err.Error() != net.InternalError.Error() {
+		t.Fatalf("boom: want %v, got %v", net.InternalError, err)
+	}
+	if reply, err := connect.Cmd("after"); err != nil || reply.Str != "after" {
+		t.Fatalf("after: got %+v, %v", reply, err)
+	}
+
+	conn := dial(t, respAddr)
+	defer conn.Close()
+	c := &respClient{t: t, conn: conn, reader: bufio.NewReader(conn)}
+	c.cmd("BOOM")
+	c.expect("-ERR Internal error.")
+	c.cmd("after")
+	c.expect("$5", "after")
+}
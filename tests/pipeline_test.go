@@ -0,0 +1,58 @@
+package tests
+
+import (
+	"github.com/awesome-cap/kv/ptl"
+	"strconv"
+	"testing"
+)
+
+func TestPipeline(t *testing.T) {
+	const n = 10000
+	pipeline := connect.Pipeline()
+	for i := 0; i < n; i++ {
+		is := strconv.Itoa(i)
+		pipeline.Cmd("set", "pipeline:"+is, is)
+	}
+	pipeline.Cmd("lpush", "pipeline:0", "x")
+	for i := 0; i < n; i++ {
+		pipeline.Cmd("get", "pipeline:"+strconv.Itoa(i))
+	}
+	replies, err := pipeline.Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replies) != 2*n+1 || pipeline.Len() != 0 {
+		t.Fatalf("exec: want %d replies, got %d", 2*n+1, len(replies))
+	}
+	// Error replies keep their place, the replies keep the order of the commands
+	if replies[n].Type != ptl.ErrorReply {
+		t.Fatalf("lpush: got %+v", replies[n])
+	}
+	for i := 0; i < n; i++ {
+		if reply := replies[n+1+i]; reply.Type != ptl.BulkReply || reply.Str != strconv.Itoa(i) {
+			t.Fatalf("get %d: got %+v", i, reply)
+		}
+	}
+
+	// The connection is still in sync
+	if reply, err := connect.Cmd("get", "pipeline:1"); err != nil || reply.Str != "1" {
+		t.Fatalf("get: got (%+v, %v)", reply, err)
+	}
+}
+
+func BenchmarkPipelineSet(b *testing.B) {
+	pipeline := connect.Pipeline()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		is := strconv.Itoa(i)
+		pipeline.Cmd("set", is, is)
+		if pipeline.Len() == 100 {
+			if _, err := pipeline.Exec(); err != nil {
+				b.Fatal(err, i)
+			}
+		}
+	}
+	if _, err := pipeline.Exec(); err != nil {
+		b.Fatal(err)
+	}
+}
@@ -0,0 +1,56 @@
+package tests
+
+import (
+	"github.com/awesome-cap/kv/ptl"
+	"reflect"
+	"testing"
+)
+
+func TestReply(t *testing.T) {
+	cmd := func(args ...string) ptl.Reply {
+		reply, err := connect.Cmd(args...)
+		if err != nil {
+			t.Fatalf("%v: %v", args, err)
+		}
+		return reply
+	}
+	cmd("del", "reply:empty", "reply:missing", "reply:hash", "reply:list")
+
+	// A missing key is told apart from an empty value
+	cmd("set", "reply:empty", "")
+	if reply := cmd("get", "reply:empty"); reply.Type != ptl.BulkReply || reply.Str != "" {
+		t.Fatalf("get empty: got %+v", reply)
+	}
+	if reply := cmd("get", "reply:missing"); reply.Type != ptl.NilReply {
+		t.Fatalf("get missing: got %+v", reply)
+	}
+	if reply := cmd("mget", "reply:empty", "reply:missing"); !reflect.DeepEqual(reply, ptl.Array(ptl.Bulk(""), ptl.Nil())) {
+		t.Fatalf("mget: got %+v", reply)
+	}
+
+	if reply := cmd("set", "reply:empty", "v", "NX"); reply.Type != ptl.NilReply {
+		t.Fatalf("set nx: got %+v", reply)
+	}
+	if reply := cmd("incrby", "reply:n", "2"); reply.Type != ptl.IntegerReply || reply.Integer < 2 {
+		t.Fatalf("incrby: got %+v", reply)
+	}
+	cmd("hset", "reply:hash", "f", "v")
+	if reply := cmd("hgetall", "reply:hash"); !reflect.DeepEqual(reply, ptl.Map([]string{"f", "v"})) {
+		t.Fatalf("hgetall: got %+v", reply)
+	}
+	if reply := cmd("lpop", "reply:list"); reply.Type != ptl.NilReply {
+		t.Fatalf("lpop: got %+v", reply)
+	}
+	if reply := cmd("blpop", "reply:list", "0.01"); reply.Type != ptl.NilArrayReply || reply.Strings() != nil {
+		t.Fatalf("blpop timeout: got %+v", reply)
+	}
+	if reply := cmd("lrange", "reply:list", "0", "-1"); !reflect.DeepEqual(reply, ptl.Array()) {
+		t.Fatalf("lrange: got %+v", reply)
+	}
+	if reply := cmd("type", "reply:hash"); !reflect.DeepEqual(reply, ptl.Status("hash")) {
+		t.Fatalf("type: got %+v", reply)
+	}
+	if _, err := connect.Cmd("lpush", "reply:hash", "x"); err == nil {
+		t.Fatal("lpush hash: want an error")
+	}
+}
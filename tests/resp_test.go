@@ -0,0 +1,126 @@
+package tests
+
+import (
+	"bufio"
+	"context"
+	"github.com/awesome-cap/kv/config"
+	"github.com/awesome-cap/kv/engine"
+	"github.com/awesome-cap/kv/net"
+	stdnet "net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// respClient sends commands as RESP arrays and reads raw replies.
+type respClient struct {
+	t      *testing.T
+	conn   stdnet.Conn
+	reader *bufio.Reader
+}
+
+func (c *respClient) send(raw string) {
+	if _, err := c.conn.Write([]byte(raw)); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *respClient) cmd(args ...string) {
+	raw := "*" + strconv.Itoa(len(args)) + "\r\n"
+	for _, arg := range args {
+		raw += "$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n"
+	}
+	c.send(raw)
+}
+
+// expect reads the given reply lines.
+func (c *respClient) expect(lines ...string) {
+	for _, want := range lines {
+		got, err := c.reader.ReadString('\n')
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		if strings.TrimRight(got, "\r\n") != want {
+			c.t.Fatalf("reply: want %q, got %q", want, got)
+		}
+	}
+}
+
+func TestResp(t *testing.T) {
+	const respAddr = ":9997"
+	conf := config.Default()
+	conf.Storage.Dir = t.TempDir()
+	e, err := engine.New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	respServer := net.NewResp(respAddr)
+	go func() {
+		_ = respServer.Serve(e.ExecContext)
+	}()
+	defer respServer.Shutdown(context.Background())
+	var conn stdnet.Conn
+	for i := 0; i < 100; i++ {
+		if conn, err = stdnet.Dial("tcp", respAddr); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := &respClient{t: t, conn: conn, reader: bufio.NewReader(conn)}
+
+	c.send("PING\r\n")
+	c.expect("+PONG")
+	c.cmd("SET", "k", "v")
+	c.expect("+OK")
+	c.cmd("SET", "k", "v", "NX")
+	c.expect("$-1")
+	c.cmd("GET", "k")
+	c.expect("$1", "v")
+	c.cmd("INCR", "n")
+	c.expect(":1")
+	c.cmd("INCRBYFLOAT", "f", "1.5")
+	c.expect("$3", "1.5")
+	c.cmd("LPUSH", "k", "x")
+	c.expect("-WRONGTYPE Operation against a key holding the wrong kind of value.")
+	c.cmd("NOSUCHCMD")
+	c.expect("-ERR Invalid cmd nosuchcmd")
+	c.cmd("HSET", "h", "f", "1")
+	c.expect(":1")
+	c.cmd("HGETALL", "h")
+	c.expect("*2", "$1", "f", "$1", "1")
+	c.cmd("BLPOP", "list", "0.01")
+	c.expect("*-1")
+	c.cmd("TYPE", "h")
+	c.expect("+hash")
+	// Pipelined commands are answered in order
+	c.send("*2\r\n$3\r\nGET\r\n$1\r\nk\r\n*2\r\n$4\r\nINCR\r\n$1\r\nn\r\nPING\r\n")
+	c.expect("$1", "v", ":2", "+PONG")
+
+	c.cmd("HELLO", "3")
+	c.expect("%3", "$6", "server", "$2", "kv", "$5", "proto", ":3", "$4", "mode", "$10", "standalone")
+	c.cmd("HGETALL", "h")
+	c.expect("%1", "$1", "f", "$1", "1")
+	c.cmd("INCRBYFLOAT", "f", "1")
+	c.expect(",2.5")
+	c.cmd("BLPOP", "list", "0.01")
+	c.expect("_")
+
+	c.send("*1\r\n!3\r\nGET\r\n")
+	c.expect("-ERR Protocol error.")
+
+	// Lines are not buffered beyond 64KB
+	long, err := stdnet.Dial("tcp", respAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer long.Close()
+	c = &respClient{t: t, conn: long, reader: bufio.NewReader(long)}
+	c.send("SET k " + strings.Repeat("v", 128*1024))
+	c.expect("-ERR Protocol error.")
+}
@@ -0,0 +1,82 @@
+package tests
+
+import (
+	"context"
+	"github.com/awesome-cap/kv/client"
+	"github.com/awesome-cap/kv/config"
+	"github.com/awesome-cap/kv/engine"
+	"github.com/awesome-cap/kv/net"
+	stdnet "net"
+	"testing"
+	"time"
+)
+
+func TestShutdown(t *testing.T) {
+	const shutdownAddr = ":9998"
+	conf := config.Default()
+	conf.Storage.Dir = t.TempDir()
+	e, err := engine.New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcpServer := net.NewTcp(shutdownAddr)
+	served := make(chan error, 1)
+	go func() {
+		served <- tcpServer.Serve(e.ExecContext)
+	}()
+	for i := 0; i < 100; i++ {
+		conn, err := stdnet.Dial("tcp", shutdownAddr)
+		if err == nil {
+			_ = conn.Close()
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	c := client.New(shutdownAddr)
+	connect, err := c.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := connect.Cmd("set", "k", "v"); err != nil {
+		t.Fatal(err)
+	}
+	blocking, err := c.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocked := make(chan error, 1)
+	go func() {
+		_, err := blocking.Cmd("blpop", "list", "0")
+		blocked <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := tcpServer.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-served; err != net.ServerClosedError {
+		t.Fatalf("serve: want %v, got %v", net.ServerClosedError, err)
+	}
+	// The blocked command is answered before its connection is closed
+	if err := <-blocked; err == nil || err.Error() != context.Canceled.Error() {
+		t.Fatalf("blpop: want %v, got %v", context.Canceled, err)
+	}
+	if _, err := stdnet.Dial("tcp", shutdownAddr); err == nil {
+		t.Fatal("dial: want an error after shutdown")
+	}
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err = engine.New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	if v, ok := e.Get("k"); !ok || v != "v" {
+		t.Fatalf("get k: want v, got (%q, %v)", v, ok)
+	}
+}